@@ -0,0 +1,624 @@
+/*
+agent.go contains the logic for running dante as an agent, a long lived server
+that builds and tests images handed to it over HTTP by `dante test --remote`,
+and for handing those images to agents
+*/
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+agentJobsPath is where an agent accepts jobs. A job is a gzipped tar archive
+holding agentSpecFile and every context the job needs, and the agent answers
+with a stream of agentEvents, one JSON object per line.
+*/
+const agentJobsPath = "/jobs"
+
+/*
+agentSpecFile is the name of the file describing a job in the archive sent to
+an agent
+*/
+const agentSpecFile = "job.yml"
+
+/*
+agentSpec describes a job sent to an agent. It is YAML, like the inventory, so
+the image comes out the other side exactly as it went in. Paths in the image
+are relative to the root of the archive.
+*/
+type agentSpec struct {
+	Image      map[string]interface{} `yaml:"image"`
+	Retries    int                    `yaml:"retries"`
+	RetryTests bool                   `yaml:"retry_tests"`
+	Diff       bool                   `yaml:"diff"`
+	Priority   int                    `yaml:"priority"`
+}
+
+/*
+agentEvent is a single line of an agent's answer to a job: a line of docker's
+output or the job's new state while the job runs, then the result once it has
+finished
+*/
+type agentEvent struct {
+	Log    string       `json:"log,omitempty"`
+	State  string       `json:"state,omitempty"`
+	Result *agentResult `json:"result,omitempty"`
+}
+
+/*
+agentResult is the outcome of a job run by an agent
+*/
+type agentResult struct {
+	Success bool         `json:"success"`
+	Output  string       `json:"output"`
+	Tests   []TestResult `json:"tests"`
+}
+
+/*
+agentTokenEnv is the environment variable the agent's token is read from when
+it isn't given as a flag, which keeps it out of the process list
+*/
+const agentTokenEnv = "DANTE_AGENT_TOKEN"
+
+/*
+remoteHosts returns a host for each agent url, for `dante test --remote`, each
+authenticating with token
+*/
+func remoteHosts(urls []string, token string) (hosts []*dockerHost) {
+	for _, url := range urls {
+		hosts = append(hosts, &dockerHost{Name: url, Agent: strings.TrimSuffix(url, "/"), Token: token})
+	}
+	return
+}
+
+/*
+agent runs the jobs it is sent through a worker pool of its own, the same way
+runTests does
+*/
+type agent struct {
+	mutex sync.Mutex
+	input chan Job
+	// pending holds where to send the result of each job still running, by
+	// the job's Id
+	pending map[int]chan Job
+	nextId  int
+	// token is the shared secret every job must be sent with, if it is set
+	token string
+}
+
+/*
+runAgent serves jobs on the address listen until it fails. Whoever can send the
+agent a job can run anything on its docker host, so without a token the agent
+only listens on loopback addresses.
+*/
+func runAgent(listen string, token string, opts TestOpts) error {
+	if token == "" && !isLoopback(listen) {
+		return fmt.Errorf("refusing to listen on `%v` without a token, set one with --token or %v", listen, agentTokenEnv)
+	}
+	a := &agent{
+		input:   make(chan Job),
+		pending: make(map[int]chan Job),
+		token:   token,
+	}
+	output := make(chan Job)
+
+	hosts := []*dockerHost{localHost}
+	scheds := newHostSchedulers(hosts, map[string]int{
+		stepBuild: opts.MaxBuilds,
+		stepTest:  opts.MaxTests,
+	})
+	reportSchedulers(hosts, scheds)
+	for i := 0; i < workerCount(opts, runtime.NumCPU()); i++ {
+		go testWorker(a.input, output, scheds)
+	}
+	go a.dispatch(output)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(agentJobsPath, a.handleJob)
+	fmt.Printf("# Agent\n\nListening for jobs on `%v`\n\n", listen)
+	return http.ListenAndServe(listen, mux)
+}
+
+/*
+isLoopback returns true if the address listen only accepts connections from
+this machine
+*/
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+/*
+authorized returns true if r carries the agent's token, or the agent doesn't
+have one
+*/
+func (a *agent) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+	expected := []byte("Bearer " + a.token)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+/*
+dispatch hands every finished job to the request waiting for it
+*/
+func (a *agent) dispatch(output chan Job) {
+	for job := range output {
+		a.mutex.Lock()
+		result := a.pending[job.Id]
+		delete(a.pending, job.Id)
+		a.mutex.Unlock()
+		result <- job
+	}
+}
+
+/*
+handleJob runs the job in the request's archive, streaming docker's output and
+the job's state back while it runs and the result once it is done
+*/
+func (a *agent) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "jobs must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(r) {
+		http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "dante-agent")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	spec, err := unpackJob(r.Body, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events := make(chan agentEvent, 256)
+	result := make(chan Job, 1)
+	job := Job{
+		Image:      spec.Image,
+		Retries:    spec.Retries,
+		RetryTests: spec.RetryTests,
+		Diff:       spec.Diff,
+		Priority:   spec.Priority,
+		Host:       localHost,
+		Log: func(line string) {
+			events <- agentEvent{Log: line}
+		},
+		State: func(state string) {
+			events <- agentEvent{State: state}
+		},
+	}
+	a.mutex.Lock()
+	job.Id = a.nextId
+	a.nextId++
+	a.pending[job.Id] = result
+	a.mutex.Unlock()
+	fmt.Printf("Running job %v for `%v` from %v\n\n", job.Id, spec.Image["name"], r.RemoteAddr)
+	go func() {
+		a.input <- job
+	}()
+
+	// Keep reading events until the job is done even if the coordinator has
+	// gone away, so the job is never stuck waiting for us
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(event agentEvent) {
+		encoder.Encode(event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	for {
+		select {
+		case event := <-events:
+			send(event)
+		case done := <-result:
+			for len(events) > 0 {
+				send(<-events)
+			}
+			// Report tests by where they are in the archive, which the
+			// coordinator knows them by
+			for i := range done.Tests {
+				if test, err := filepath.Rel(dir, done.Tests[i].Test); err == nil {
+					done.Tests[i].Test = filepath.ToSlash(test)
+				}
+			}
+			send(agentEvent{Result: &agentResult{
+				Success: done.Success,
+				Output:  done.Output,
+				Tests:   done.Tests,
+			}})
+			return
+		}
+	}
+}
+
+/*
+unpackJob extracts the archive of a job into dir, returning its spec with every
+path in its image made absolute
+*/
+func unpackJob(archive io.Reader, dir string) (spec agentSpec, err error) {
+	err = unpackArchive(archive, dir)
+	if err != nil {
+		return
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, agentSpecFile))
+	if err != nil {
+		return spec, fmt.Errorf("job has no %v", agentSpecFile)
+	}
+	err = yaml.Unmarshal(contents, &spec)
+	if err != nil {
+		return spec, fmt.Errorf("could not read %v: %v", agentSpecFile, err)
+	}
+	if spec.Image == nil {
+		return spec, fmt.Errorf("%v has no image", agentSpecFile)
+	}
+
+	if path, ok := spec.Image["path"].(string); ok {
+		spec.Image["path"] = filepath.Join(dir, filepath.FromSlash(path))
+	}
+	resolveTestPaths(spec.Image, dir)
+	err = verifyInventory(Inventory{"images": {spec.Image}})
+	return
+}
+
+/*
+packJob returns the spec sent to an agent for job, along with the files the job
+needs, mapping where each goes in the archive to where it is on this machine.
+tests holds the archive path of each Dockerfile test in the same way.
+*/
+func packJob(job Job) (spec []byte, files map[string]string, tests map[string]string, err error) {
+	tests = make(map[string]string)
+	image := make(map[string]interface{})
+	for key, value := range job.Image {
+		image[key] = value
+	}
+	delete(image, "source")
+
+	// Every path is replaced with where it will be in the archive
+	files = make(map[string]string)
+	image["path"] = "context"
+	files["context"], _ = job.Image["path"].(string)
+	entries := []interface{}{}
+	for i, entry := range getTestEntries(job.Image) {
+		prefix := "tests/" + strconv.Itoa(i)
+		if path, ok := entry.(string); ok {
+			files[prefix] = path
+			tests[prefix] = path
+			entries = append(entries, prefix)
+			continue
+		}
+		fields, ok := yamlMap(entry)
+		if !ok {
+			entries = append(entries, entry)
+			continue
+		}
+		packed := make(map[string]interface{})
+		for key, value := range fields {
+			packed[key] = value
+		}
+		for _, key := range []string{"path", "db", "allowlist"} {
+			if path, ok := fields[key].(string); ok {
+				name := prefix
+				if key != "path" {
+					name = prefix + "-" + key
+				}
+				files[name] = path
+				packed[key] = name
+				if key == "path" {
+					tests[name] = path
+				}
+			}
+		}
+		entries = append(entries, packed)
+	}
+	if _, ok := image["test"]; ok {
+		image["test"] = entries
+	}
+
+	spec, err = yaml.Marshal(agentSpec{
+		Image:      image,
+		Retries:    job.Retries,
+		RetryTests: job.RetryTests,
+		Diff:       job.Diff,
+		Priority:   job.Priority,
+	})
+	return
+}
+
+/*
+writeJobArchive writes the archive of a job to w, made of its spec and files as
+returned by packJob
+*/
+func writeJobArchive(w io.Writer, spec []byte, files map[string]string) (err error) {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	err = archive.WriteHeader(&tar.Header{Name: agentSpecFile, Mode: 0644, Size: int64(len(spec))})
+	if err == nil {
+		_, err = archive.Write(spec)
+	}
+	for name, path := range files {
+		if err != nil {
+			break
+		}
+		err = addToArchive(archive, path, name)
+	}
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := compressed.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+/*
+addToArchive adds the file or directory at path to archive as name
+*/
+func addToArchive(archive *tar.Writer, path string, name string) error {
+	return filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(file)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(name, rel))
+		err = archive.WriteHeader(header)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		contents, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer contents.Close()
+		_, err = io.Copy(archive, contents)
+		return err
+	})
+}
+
+/*
+unpackArchive extracts the gzipped tar archive r into dir. Entries that would
+land outside of dir are refused, and so is anything that could lead a later
+entry out of it: symlinks that are absolute or climb with `..`, and writing
+through a symlink that is already there. Other kinds of entry, such as hard
+links and devices, are skipped.
+*/
+func unpackArchive(r io.Reader, dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	compressed, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewReader(compressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !withinDir(dir, target) {
+			return fmt.Errorf("archive entry `%v` is outside of the job", header.Name)
+		}
+		if target != dir {
+			err = checkArchiveTarget(root, target)
+			if err != nil {
+				return fmt.Errorf("archive entry `%v` %v", header.Name, err)
+			}
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0700)
+		case tar.TypeSymlink:
+			link := filepath.FromSlash(header.Linkname)
+			if filepath.IsAbs(link) || hasParentElement(link) {
+				return fmt.Errorf("archive entry `%v` links to `%v`, which could be outside of the job", header.Name, header.Linkname)
+			}
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = os.Symlink(link, target)
+			}
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = writeArchiveFile(archive, target, mode)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+withinDir returns true if path is dir or somewhere beneath it
+*/
+func withinDir(dir string, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+/*
+hasParentElement returns true if path climbs to a parent directory anywhere
+along the way
+*/
+func hasParentElement(path string) bool {
+	for _, element := range strings.Split(path, string(filepath.Separator)) {
+		if element == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+checkArchiveTarget returns an error if writing target would go through a
+symlink already unpacked, or if the directories leading to it really lead
+somewhere outside of root. Only the part of the path that exists so far is
+checked, since the rest will be created as plain directories.
+*/
+func checkArchiveTarget(root string, target string) error {
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("would be written through a symlink")
+	}
+	existing := filepath.Dir(target)
+	for {
+		if _, err := os.Lstat(existing); err == nil || existing == filepath.Dir(existing) {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if !withinDir(root, real) {
+		return fmt.Errorf("is inside `%v`, which leads outside of the job", existing)
+	}
+	return nil
+}
+
+/*
+writeArchiveFile writes the contents of the current entry of archive to target
+*/
+func writeArchiveFile(archive io.Reader, target string, mode os.FileMode) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, archive)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/*
+runRemote sends job to the agent it is assigned to and waits for the result,
+handing each line the agent streams back to job.Log
+*/
+func runRemote(job Job) Job {
+	name := job.Image["name"].(string)
+	failed := func(format string, args ...interface{}) Job {
+		job.Success = false
+		job.Output = fmt.Sprintf("# Tested image `%v`\n\n**Failed** running on agent `%v`: ", name, job.Host.Name) + fmt.Sprintf(format, args...) + "\n\n"
+		return finishJob(job)
+	}
+
+	spec, files, tests, err := packJob(job)
+	if err != nil {
+		return failed("`%v`", err)
+	}
+
+	// Stream the archive to the agent as it is written, rather than holding
+	// every context in memory
+	body, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeJobArchive(writer, spec, files))
+	}()
+
+	request, err := http.NewRequest(http.MethodPost, job.Host.Agent+agentJobsPath, body)
+	if err != nil {
+		body.Close()
+		return failed("`%v`", err)
+	}
+	request.Header.Set("Content-Type", "application/gzip")
+	if job.Host.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+job.Host.Token)
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(jobContext))
+	if err != nil {
+		job.Cancelled = jobContext.Err() != nil
+		return failed("`%v`", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return failed("%v: `%v`", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event agentEvent
+		err = decoder.Decode(&event)
+		if err == io.EOF {
+			return failed("the agent hung up before the job finished")
+		}
+		if err != nil {
+			job.Cancelled = jobContext.Err() != nil
+			return failed("`%v`", err)
+		}
+		if event.Log != "" && job.Log != nil {
+			job.Log(event.Log)
+		}
+		if event.State != "" {
+			job.setState(event.State)
+		}
+		if event.Result == nil {
+			continue
+		}
+
+		job.Success = event.Result.Success
+		job.Output = strings.Replace(event.Result.Output, "\n\n", fmt.Sprintf("\n\nRan on agent `%v`\n\n", job.Host.Name), 1)
+		job.Tests = event.Result.Tests
+		for i := range job.Tests {
+			job.Tests[i].Image = name
+			if test, ok := tests[job.Tests[i].Test]; ok {
+				job.Tests[i].Test = test
+			}
+		}
+		return finishJob(job)
+	}
+}
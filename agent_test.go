@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+archiveEntry is an entry of an archive built for a test. Entries with a link are
+symlinks, the rest are files holding contents.
+*/
+type archiveEntry struct {
+	name     string
+	link     string
+	contents string
+}
+
+/*
+buildArchive returns a gzipped tar archive holding entries, in order
+*/
+func buildArchive(t *testing.T, entries []archiveEntry) *bytes.Buffer {
+	var buffer bytes.Buffer
+	compressed := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(compressed)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.contents))}
+		if entry.link != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.link}
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(entry.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestUnpackArchive(t *testing.T) {
+	dir := t.TempDir()
+	err := unpackArchive(buildArchive(t, []archiveEntry{
+		{name: "job.yml", contents: "image: {}\n"},
+		{name: "context/Dockerfile", contents: "FROM alpine\n"},
+		{name: "context/current", link: "Dockerfile"},
+		{name: "context/nested/file", contents: "nested\n"},
+		{name: "context/link", link: "nested/file"},
+	}), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "context", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "nested\n" {
+		t.Errorf("expected the link to lead to `nested`, got %q", contents)
+	}
+}
+
+func TestUnpackArchiveRefusesEscapes(t *testing.T) {
+	for name, entries := range map[string][]archiveEntry{
+		"parent path":      {{name: "../escaped", contents: "x"}},
+		"absolute link":    {{name: "link", link: "/tmp"}},
+		"climbing link":    {{name: "link", link: "../"}},
+		"hidden climb":     {{name: "link", link: "sub/../../x"}},
+		"overwrite a link": {{name: "link", link: "file"}, {name: "link", contents: "x"}},
+		"link to a link":   {{name: "here", link: "."}, {name: "up", link: "here/../escaped"}},
+		"replace a link":   {{name: "dir", link: "sub"}, {name: "dir", link: "other"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "job")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := unpackArchive(buildArchive(t, entries), dir); err == nil {
+				t.Error("the archive was unpacked")
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escaped")); err == nil {
+				t.Error("a file was written outside of the job")
+			}
+		})
+	}
+}
+
+func TestUnpackArchiveRefusesLinkedParent(t *testing.T) {
+	// A directory that was a symlink to somewhere else before unpacking
+	// started must not be written through either
+	outside := t.TempDir()
+	dir := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "context")); err != nil {
+		t.Fatal(err)
+	}
+	err := unpackArchive(buildArchive(t, []archiveEntry{
+		{name: "context/escaped", contents: "x"},
+	}), dir)
+	if err == nil {
+		t.Error("the archive was unpacked")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "escaped")); err == nil {
+		t.Error("a file was written outside of the job")
+	}
+}
+
+func TestAgentAuthorized(t *testing.T) {
+	for _, test := range []struct {
+		token    string
+		header   string
+		expected bool
+	}{
+		{"", "", true},
+		{"secret", "Bearer secret", true},
+		{"secret", "", false},
+		{"secret", "Bearer wrong", false},
+		{"secret", "secret", false},
+	} {
+		request := httptest.NewRequest("POST", agentJobsPath, nil)
+		if test.header != "" {
+			request.Header.Set("Authorization", test.header)
+		}
+		a := &agent{token: test.token}
+		if authorized := a.authorized(request); authorized != test.expected {
+			t.Errorf("token %q with header %q: authorized %v, expected %v", test.token, test.header, authorized, test.expected)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for listen, expected := range map[string]bool{
+		"127.0.0.1:8377": true,
+		"localhost:8377": true,
+		"[::1]:8377":     true,
+		":8377":          false,
+		"0.0.0.0:8377":   false,
+		"10.0.0.5:8377":  false,
+		"builder:8377":   false,
+		"nonsense":       false,
+	} {
+		if isLoopback(listen) != expected {
+			t.Errorf("isLoopback(%q) = %v, expected %v", listen, !expected, expected)
+		}
+	}
+}
+
+func TestRunAgentNeedsToken(t *testing.T) {
+	if err := runAgent(":8377", "", TestOpts{}); err == nil {
+		t.Error("the agent listened on every address without a token")
+	}
+}
@@ -4,39 +4,88 @@ import (
 	"fmt"
 )
 
-func runAlias(inventory Inventory) (errs int) {
-	i := 0
-	fmt.Printf("# Tagging Aliases\n\n")
-	for _, image := range inventory["images"] {
-		name := image["name"].(string)
-		aliases := getAliasArray(image)
-		for _, alias := range aliases {
-			fmt.Printf("%v. %v -> %v\n", i, name, alias)
-			i++
-			output, err := dockerAlias(name, alias)
-			if err != nil {
-				fmt.Printf("Error creating tag:\n\n```\n%v\n```\n\n%v\n", output, err)
-				errs++
-			}
+/*
+tagAliases tags an image on host with every one of its aliases as a single
+step. Each alias is verified to point at the same image id as the image itself,
+and if any alias can not be created or verified, every alias created so far is
+rolled back to whatever it pointed at before we touched it.
+*/
+func tagAliases(host *dockerHost, image ImageDefinition) (output string, err error) {
+	name := image["name"].(string)
+	aliases := getAliasArray(image)
+	if len(aliases) == 0 {
+		return
+	}
+
+	output = fmt.Sprintf("## Tagging Aliases\n\n")
+
+	var id string
+	id, err = imageId(host, name)
+	if err != nil {
+		output = output + fmt.Sprintf("**Failed** Could not find image `%v`: `%v`\n\n", name, err)
+		return
+	}
+
+	// previous maps each alias we have tagged to the id it pointed at before,
+	// or the empty string if it didn't exist yet
+	previous := make(map[string]string)
+	tagged := []string{}
+
+	for i, alias := range aliases {
+		output = output + fmt.Sprintf("%v. %v -> %v\n", i, name, alias)
+
+		// If the alias already exists, remember where it pointed so we can put it
+		// back. An error here simply means the alias doesn't exist yet.
+		previous[alias], _ = imageId(host, alias)
+
+		var result string
+		result, err = dockerAlias(host, name, alias)
+		if err != nil {
+			output = output + fmt.Sprintf("\n**Failed** creating tag:\n\n```\n%v\n```\n\n%v\n\n", result, err)
+			break
+		}
+		tagged = append(tagged, alias)
+
+		// Make sure the alias really points at our image
+		var aliasId string
+		aliasId, err = imageId(host, alias)
+		if err == nil && aliasId != id {
+			err = fmt.Errorf("alias %v points to %v instead of %v", alias, aliasId, id)
+		}
+		if err != nil {
+			output = output + fmt.Sprintf("\n**Failed** verifying tag: `%v`\n\n", err)
+			break
 		}
 	}
-	fmt.Printf("\n")
-	return
-}
 
-func getAliasArray(image map[string]interface{}) (aliases []string) {
-	switch image["alias"].(type) {
-	case string:
-		// If the value is a single string, append it to the array and be done
-		aliases = append(aliases, image["alias"].(string))
-		break
-	case []interface{}:
-		// If the value is an array, iterate through and add all of the strings
-		// to the array one by one.
-		for _, str := range image["alias"].([]interface{}) {
-			aliases = append(aliases, str.(string))
+	if err == nil {
+		output = output + fmt.Sprintf("\nAll aliases point to `%v`\n\n", id)
+		return
+	}
+
+	// Something went wrong, undo every alias we created
+	output = output + fmt.Sprintf("Rolling back aliases\n\n")
+	for _, alias := range tagged {
+		var result string
+		var rollbackErr error
+		if previous[alias] != "" {
+			result, rollbackErr = dockerAlias(host, previous[alias], alias)
+		} else {
+			result, rollbackErr = removeImage(host, alias)
+		}
+		if rollbackErr != nil {
+			output = output + fmt.Sprintf("**Failed** rolling back `%v`:\n\n```\n%v\n```\n\n%v\n\n", alias, result, rollbackErr)
 		}
-		break
 	}
+
 	return
 }
+
+/*
+getAliasArray takes a single image from the inventory.yml file and converts its
+alias key to an array of strings, accepting either a single string or an array
+of strings as a value.
+*/
+func getAliasArray(image map[string]interface{}) (aliases []string) {
+	return getStringArray(image, "alias")
+}
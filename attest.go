@@ -0,0 +1,485 @@
+/*
+attest.go contains the logic for recording how an image was built (its
+provenance) and what is installed in it (its SBOM) as in-toto attestations
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// inTotoStatementType is the type of every attestation dante writes
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	// inTotoMediaType is the media type attestations are attached to images as
+	inTotoMediaType = "application/vnd.in-toto+json"
+	// provenancePredicateType identifies a SLSA provenance attestation
+	provenancePredicateType = "https://slsa.dev/provenance/v1"
+	// sbomPredicateType identifies an SPDX SBOM attestation
+	sbomPredicateType = "https://spdx.dev/Document"
+	// danteBuildType identifies how dante builds images in provenance
+	danteBuildType = "https://github.com/retrohacker/dante/build@v1"
+	// danteBuilderId identifies dante as the builder in provenance
+	danteBuilderId = "https://github.com/retrohacker/dante"
+	// ociEmptyMediaType is the media type of the empty config of an artifact
+	ociEmptyMediaType = "application/vnd.oci.empty.v1+json"
+	// ociTitleAnnotation names the file a layer of an artifact came from
+	ociTitleAnnotation = "org.opencontainers.image.title"
+)
+
+/*
+Statement is an in-toto attestation about a set of subjects
+*/
+type Statement struct {
+	Type          string      `json:"_type"`
+	Subject       []Subject   `json:"subject"`
+	PredicateType string      `json:"predicateType"`
+	Predicate     interface{} `json:"predicate"`
+}
+
+/*
+Subject is an artifact an attestation is about, identified by its digests
+*/
+type Subject struct {
+	Name   string            `json:"name,omitempty"`
+	Uri    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+/*
+Provenance is a SLSA v1 provenance predicate
+*/
+type Provenance struct {
+	BuildDefinition struct {
+		BuildType            string                 `json:"buildType"`
+		ExternalParameters   map[string]interface{} `json:"externalParameters"`
+		ResolvedDependencies []Subject              `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			Id      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  string `json:"startedOn"`
+			FinishedOn string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+/*
+SPDXDocument is the subset of an SPDX 2.3 document dante fills in for an SBOM
+*/
+type SPDXDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages []SPDXPackage `json:"packages"`
+}
+
+/*
+SPDXPackage is a single package installed in an image
+*/
+type SPDXPackage struct {
+	Name             string `json:"name"`
+	SPDXID           string `json:"SPDXID"`
+	VersionInfo      string `json:"versionInfo"`
+	DownloadLocation string `json:"downloadLocation"`
+	Comment          string `json:"comment,omitempty"`
+}
+
+/*
+Package is a package installed in an image by its package manager
+*/
+type Package struct {
+	Name    string
+	Version string
+	// Manager is the package manager that installed it: deb, apk or rpm
+	Manager string
+}
+
+/*
+listPackagesScript asks whichever package manager an image has for the packages
+it installed, printing one `name<TAB>version<TAB>manager` line per package
+*/
+const listPackagesScript = `
+if command -v dpkg-query >/dev/null 2>&1; then
+	dpkg-query -W -f '${Package}\t${Version}\tdeb\n'
+elif [ -f /lib/apk/db/installed ]; then
+	awk -F: '/^P:/{p=$2} /^V:/{print p "\t" $2 "\tapk"}' /lib/apk/db/installed
+elif command -v rpm >/dev/null 2>&1; then
+	rpm -qa --qf '%{NAME}\t%{VERSION}-%{RELEASE}\trpm\n'
+fi
+`
+
+/*
+listPackages runs a throwaway container from image on host and returns the
+packages installed in it. Images without a shell or a package manager we
+recognize return an error or no packages respectively.
+*/
+func listPackages(host *dockerHost, image string) (packages []Package, err error) {
+	output, err := execDocker(host, "/", "run", "--rm", "--entrypoint", "sh", image, "-c", listPackagesScript)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", err, output)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) == 3 {
+			packages = append(packages, Package{Name: fields[0], Version: fields[1], Manager: fields[2]})
+		}
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Name < packages[j].Name
+	})
+	return
+}
+
+/*
+fileDigest returns the hex encoded sha256 of the file at path
+*/
+func fileDigest(path string) (digest string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+contextDigest returns a sha256 identifying the contents of the build context
+dir. It covers the path, mode and contents of every file, walked in sorted
+order, so it only changes when something docker would see changes.
+*/
+func contextDigest(dir string) (digest string, err error) {
+	hash := sha256.New()
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		contents := ""
+		if info.Mode().IsRegular() {
+			contents, err = fileDigest(path)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(hash, "%v\x00%v\x00%v\n", filepath.ToSlash(rel), info.Mode(), contents)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+imageDigest returns an image id such as `sha256:abc...` as a digest map
+*/
+func imageDigest(id string) map[string]string {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 {
+		return map[string]string{"sha256": id}
+	}
+	return map[string]string{parts[0]: parts[1]}
+}
+
+/*
+buildProvenance records how image was built: the Dockerfile, context and base
+image that went in, the build args it was built with, and the image that came
+out. started and finished bound the build.
+*/
+func buildProvenance(host *dockerHost, image ImageDefinition, started time.Time, finished time.Time) (statement Statement, err error) {
+	name := image["name"].(string)
+	path := image["path"].(string)
+
+	id, err := imageId(host, name)
+	if err != nil {
+		return statement, fmt.Errorf("could not find image `%v`: %v", name, err)
+	}
+
+	var provenance Provenance
+	provenance.BuildDefinition.BuildType = danteBuildType
+	provenance.BuildDefinition.ExternalParameters = map[string]interface{}{
+		"name":      name,
+		"path":      path,
+		"buildArgs": getBuildArgs(image),
+	}
+
+	dockerfile, err := fileDigest(filepath.Join(path, "Dockerfile"))
+	if err != nil {
+		return
+	}
+	context, err := contextDigest(path)
+	if err != nil {
+		return
+	}
+	dependencies := []Subject{
+		{Name: "Dockerfile", Uri: "file:" + filepath.ToSlash(filepath.Join(path, "Dockerfile")), Digest: map[string]string{"sha256": dockerfile}},
+		{Name: "context", Uri: "file:" + filepath.ToSlash(path), Digest: map[string]string{"sha256": context}},
+	}
+
+	base, err := imageBase(image)
+	if err != nil {
+		return
+	}
+	if base != "" && strings.ToLower(base) != "scratch" {
+		var baseId string
+		baseId, err = imageId(host, base)
+		if err != nil {
+			return statement, fmt.Errorf("could not find base image `%v`: %v", base, err)
+		}
+		dependencies = append(dependencies, Subject{Name: "base", Uri: "docker-image://" + base, Digest: imageDigest(baseId)})
+	}
+
+	if revision := gitOutput(sourceDir(image), "rev-parse", "HEAD"); revision != "" {
+		dependencies = append(dependencies, Subject{
+			Name:   "source",
+			Uri:    gitOutput(sourceDir(image), "config", "--get", "remote.origin.url"),
+			Digest: map[string]string{"gitCommit": revision},
+		})
+	}
+	provenance.BuildDefinition.ResolvedDependencies = dependencies
+
+	dockerVersion, _ := execDocker(host, "/", "version", "--format", "{{.Server.Version}}")
+	provenance.RunDetails.Builder.Id = danteBuilderId
+	provenance.RunDetails.Builder.Version = map[string]string{
+		"dante":  version,
+		"docker": strings.TrimSpace(dockerVersion),
+	}
+	provenance.RunDetails.Metadata.StartedOn = started.UTC().Format(time.RFC3339)
+	provenance.RunDetails.Metadata.FinishedOn = finished.UTC().Format(time.RFC3339)
+
+	statement = Statement{
+		Type:          inTotoStatementType,
+		Subject:       []Subject{{Name: name, Digest: imageDigest(id)}},
+		PredicateType: provenancePredicateType,
+		Predicate:     provenance,
+	}
+	return
+}
+
+/*
+buildSBOM lists the packages installed in image as an SPDX document. Images
+without a shell, such as scratch and distroless images, can't be asked for
+their packages; their SBOM lists none, and warning says why.
+*/
+func buildSBOM(host *dockerHost, image ImageDefinition) (statement Statement, warning string, err error) {
+	name := image["name"].(string)
+
+	id, err := imageId(host, name)
+	if err != nil {
+		return statement, "", fmt.Errorf("could not find image `%v`: %v", name, err)
+	}
+
+	packages, listErr := listPackages(host, name)
+	if listErr != nil {
+		warning = fmt.Sprintf("could not list the packages in `%v`, so its SBOM lists none: `%v`", name, strings.TrimSpace(listErr.Error()))
+	}
+
+	var document SPDXDocument
+	document.SPDXVersion = "SPDX-2.3"
+	document.DataLicense = "CC0-1.0"
+	document.SPDXID = "SPDXRef-DOCUMENT"
+	document.Name = name
+	document.DocumentNamespace = danteBuilderId + "/spdx/" + strings.Replace(id, ":", "-", 1)
+	document.CreationInfo.Created = time.Now().UTC().Format(time.RFC3339)
+	document.CreationInfo.Creators = []string{"Tool: dante-" + version}
+	document.Packages = []SPDXPackage{}
+	for i, pkg := range packages {
+		document.Packages = append(document.Packages, SPDXPackage{
+			Name:             pkg.Name,
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%v", i),
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			Comment:          "installed by " + pkg.Manager,
+		})
+	}
+
+	statement = Statement{
+		Type:          inTotoStatementType,
+		Subject:       []Subject{{Name: name, Digest: imageDigest(id)}},
+		PredicateType: sbomPredicateType,
+		Predicate:     document,
+	}
+	return
+}
+
+/*
+unsafeFileChars matches the characters of an image name that can't be used in
+a file name
+*/
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+/*
+attestationPath returns where the attestation of kind (`provenance` or `sbom`)
+for the image name lives in dir
+*/
+func attestationPath(dir string, name string, kind string) string {
+	return filepath.Join(dir, unsafeFileChars.ReplaceAllString(name, "_")+"."+kind+".intoto.json")
+}
+
+/*
+writeAttestations writes the provenance and SBOM of image into dir, returning a
+markdown log of what it did
+*/
+func writeAttestations(host *dockerHost, dir string, image ImageDefinition, started time.Time, finished time.Time) (output string, err error) {
+	name := image["name"].(string)
+	output = fmt.Sprintf("## Attestations\n\n")
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		output = output + fmt.Sprintf("**Failed** creating `%v`: `%v`\n\n", dir, err)
+		return
+	}
+
+	provenance, err := buildProvenance(host, image, started, finished)
+	if err != nil {
+		output = output + fmt.Sprintf("**Failed** recording provenance: `%v`\n\n", err)
+		return
+	}
+	sbom, warning, err := buildSBOM(host, image)
+	if err != nil {
+		output = output + fmt.Sprintf("**Failed** listing packages: `%v`\n\n", err)
+		return
+	}
+	if warning != "" {
+		output = output + fmt.Sprintf("**Warning**: %v\n\n", warning)
+	}
+
+	for kind, statement := range map[string]Statement{"provenance": provenance, "sbom": sbom} {
+		var contents []byte
+		contents, err = json.MarshalIndent(statement, "", "  ")
+		if err != nil {
+			output = output + fmt.Sprintf("**Failed** encoding %v: `%v`\n\n", kind, err)
+			return
+		}
+		path := attestationPath(dir, name, kind)
+		err = ioutil.WriteFile(path, contents, 0644)
+		if err != nil {
+			output = output + fmt.Sprintf("**Failed** writing `%v`: `%v`\n\n", path, err)
+			return
+		}
+	}
+
+	output = output + fmt.Sprintf("* Provenance: `%v`\n", attestationPath(dir, name, "provenance"))
+	output = output + fmt.Sprintf("* SBOM: `%v` (%v packages)\n\n", attestationPath(dir, name, "sbom"), len(sbom.Predicate.(SPDXDocument).Packages))
+	return
+}
+
+/*
+attachAttestations attaches the attestations for the image name found in dir
+to ref, pushed as the manifest digest, as OCI artifacts whose subject is that
+manifest, the same way `oras attach` does. The attestations were written before
+the push, when only the local image ID was known, so their subject is replaced
+with the pushed manifest first. It returns a markdown log of what it did.
+*/
+func attachAttestations(dir string, name string, ref string, digest string) (output string, err error) {
+	output = fmt.Sprintf("## Attaching Attestations\n\n")
+	fail := func(format string, args ...interface{}) (string, error) {
+		err = fmt.Errorf(format, args...)
+		return output + fmt.Sprintf("**Failed** attaching attestations to `%v`: `%v`\n\n", ref, err), err
+	}
+
+	subjectRegistry, subjectName, _ := splitReference(ref)
+	if subjectRegistry != "" {
+		subjectName = subjectRegistry + "/" + subjectName
+	}
+	registry, repository, _ := resolveReference(ref)
+	client := newRegistryClient(registry)
+
+	// Artifacts point back at the manifest they describe
+	target, err := client.getManifest(repository, digest)
+	if err != nil {
+		return fail("reading %v: %v", digest, err)
+	}
+	var targetType struct {
+		MediaType string `json:"mediaType"`
+	}
+	json.Unmarshal(target, &targetType)
+	if targetType.MediaType == "" {
+		targetType.MediaType = ociManifestMediaType
+	}
+	subject := &ociDescriptor{MediaType: targetType.MediaType, Size: len(target), Digest: digest}
+
+	config := []byte("{}")
+	configDigest, err := client.putBlob(repository, config)
+	if err != nil {
+		return fail("uploading config: %v", err)
+	}
+
+	for _, kind := range []string{"provenance", "sbom"} {
+		path := attestationPath(dir, name, kind)
+		var contents []byte
+		contents, err = ioutil.ReadFile(path)
+		if err != nil {
+			return fail("finding %v for `%v`: %v", kind, name, err)
+		}
+		var statement Statement
+		err = json.Unmarshal(contents, &statement)
+		if err != nil {
+			return fail("reading %v for `%v`: %v", kind, name, err)
+		}
+		statement.Subject = []Subject{{Name: subjectName, Digest: imageDigest(digest)}}
+		contents, err = json.MarshalIndent(statement, "", "  ")
+		if err != nil {
+			return fail("%v", err)
+		}
+
+		var layerDigest string
+		layerDigest, err = client.putBlob(repository, contents)
+		if err != nil {
+			return fail("uploading %v: %v", kind, err)
+		}
+		manifest := ociManifest{
+			SchemaVersion: 2,
+			MediaType:     ociManifestMediaType,
+			ArtifactType:  inTotoMediaType,
+			Config:        ociDescriptor{MediaType: ociEmptyMediaType, Size: len(config), Digest: configDigest},
+			Layers: []ociDescriptor{{
+				MediaType:   inTotoMediaType,
+				Size:        len(contents),
+				Digest:      layerDigest,
+				Annotations: map[string]string{ociTitleAnnotation: filepath.Base(path)},
+			}},
+			Subject: subject,
+		}
+		var manifestBytes []byte
+		manifestBytes, err = json.Marshal(manifest)
+		if err != nil {
+			return fail("%v", err)
+		}
+		err = client.putManifest(repository, blobDigest(manifestBytes), ociManifestMediaType, manifestBytes)
+		if err != nil {
+			return fail("uploading %v: %v", kind, err)
+		}
+		output = output + fmt.Sprintf("Attached `%v` to `%v@%v` as `%v`\n\n", filepath.Base(path), subjectName, digest, blobDigest(manifestBytes))
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAttachAttestations(t *testing.T) {
+	registry, address := startRegistry(t)
+	ref := address + "/test/image:1"
+	digest := imageManifestDigest
+
+	dir := t.TempDir()
+	for _, kind := range []string{"provenance", "sbom"} {
+		statement, _ := json.Marshal(Statement{
+			Type:          inTotoStatementType,
+			Subject:       []Subject{{Name: "test/image:1", Digest: imageDigest("sha256:local")}},
+			PredicateType: kind,
+		})
+		if err := ioutil.WriteFile(attestationPath(dir, "test/image:1", kind), statement, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if output, err := attachAttestations(dir, "test/image:1", ref, digest); err != nil {
+		t.Fatalf("attaching failed: %v\n%v", err, output)
+	}
+
+	// Each attestation is an artifact pointing at the pushed manifest, and
+	// names that manifest as its subject
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	attached := map[string]bool{}
+	for _, contents := range registry.manifests {
+		var manifest ociManifest
+		if json.Unmarshal(contents, &manifest) != nil || manifest.Subject == nil {
+			continue
+		}
+		if manifest.Subject.Digest != digest || manifest.ArtifactType != inTotoMediaType || len(manifest.Layers) != 1 {
+			t.Errorf("unexpected artifact manifest: %s", contents)
+			continue
+		}
+		var statement Statement
+		if err := json.Unmarshal(registry.blobs[manifest.Layers[0].Digest], &statement); err != nil {
+			t.Fatal(err)
+		}
+		if statement.Subject[0].Name != address+"/test/image" || statement.Subject[0].Digest["sha256"] != digest[len("sha256:"):] {
+			t.Errorf("%v names %v as its subject", statement.PredicateType, statement.Subject)
+		}
+		attached[statement.PredicateType] = true
+	}
+	if !attached["provenance"] || !attached["sbom"] {
+		t.Errorf("expected provenance and sbom to be attached, got %v", attached)
+	}
+}
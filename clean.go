@@ -0,0 +1,196 @@
+/*
+clean.go contains all of the logic specific to the clean command, which removes
+what dante leaves behind on the host
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+danglingName is how `docker images` lists an image that has no name
+*/
+const danglingName = "<none>:<none>"
+
+/*
+CleanOpts controls what the clean command removes
+*/
+type CleanOpts struct {
+	// Images also removes the images built from the inventory, not just tests
+	Images bool
+	// DryRun lists what would be removed without removing anything
+	DryRun bool
+	// Hosts are the docker hosts to remove images from
+	Hosts []*dockerHost
+	// Inventory, if there is one, limits the images removed to the ones built
+	// for its images
+	Inventory Inventory
+}
+
+/*
+runClean removes the test images dante built on each of opts.Hosts, found by
+the labels dante applies at build time, and any temporary test contexts left in
+the current working directory. It returns the number of things that couldn't be
+removed.
+*/
+func runClean(opts CleanOpts) (errs int) {
+	verb := "Removed"
+	if opts.DryRun {
+		verb = "Would remove"
+	}
+
+	roles := []string{roleTest}
+	if opts.Images {
+		roles = append(roles, roleImage)
+	}
+
+	var references map[string][]string
+	if opts.Inventory != nil {
+		references = make(map[string][]string)
+		for _, image := range opts.Inventory["images"] {
+			references[image["name"].(string)] = getPushReferences(image)
+		}
+	}
+
+	fmt.Printf("# Cleaning Images\n\n")
+	for _, host := range opts.Hosts {
+		for _, role := range roles {
+			errs += cleanImages(host, role, verb, opts.DryRun, references)
+		}
+	}
+	fmt.Printf("\n")
+
+	fmt.Printf("# Cleaning Temporary Contexts\n\n")
+	contexts, err := filepath.Glob(tempPath + "*")
+	if err != nil {
+		fmt.Printf("**Failed** listing temporary contexts: `%v`\n\n", err)
+		return errs + 1
+	}
+	for _, context := range contexts {
+		if !opts.DryRun {
+			err = os.RemoveAll(context)
+			if err != nil {
+				fmt.Printf("* **Failed** removing `%v`: `%v`\n", context, err)
+				errs++
+				continue
+			}
+		}
+		fmt.Printf("* %v `%v`\n", verb, context)
+	}
+	fmt.Printf("\n")
+
+	return
+}
+
+/*
+cleanImages removes the images dante built with role from host, printing a line
+for each. Images built FROM an image dante built inherit its labels, so an
+image only counts as dante's while it is still tagged with the name dante gave
+it. references maps each inventory image to the names it is tagged with, and
+images built for anything else are left alone; without an inventory it is nil
+and the image's own label is trusted. Only those tags are removed, so docker
+keeps any image something else still refers to. Test images that have lost
+their name to a newer build of the same test are removed by ID. It returns the number of images
+that couldn't be removed.
+*/
+func cleanImages(host *dockerHost, role string, verb string, dryRun bool, references map[string][]string) (errs int) {
+	images, err := listImages(host, labelRole+"="+role)
+	if err != nil {
+		fmt.Printf("**Failed** listing %v images on `%v`: `%v`\n\n", role, host.Name, err)
+		return 1
+	}
+
+	// An image with several tags is listed once per tag
+	ids := []string{}
+	tags := make(map[string][]string)
+	for _, image := range images {
+		if _, ok := tags[image.Id]; !ok {
+			ids = append(ids, image.Id)
+		}
+		tags[image.Id] = append(tags[image.Id], image.Name)
+	}
+
+	for _, id := range ids {
+		config, err := inspectConfig(host, id)
+		if err != nil {
+			fmt.Printf("* **Failed** inspecting %v image `%v`: `%v`\n", role, id, err)
+			errs++
+			continue
+		}
+		owner := config.Labels[labelImage]
+		expected := []string{owner}
+		if references != nil {
+			refs, ok := references[owner]
+			if !ok {
+				continue
+			}
+			expected = refs
+		}
+		if role == roleTest {
+			expected = []string{owner + "-test" + config.Labels[labelTestNumber]}
+		}
+
+		// A test image left without a name, because the test was built again
+		// since, can only be removed by its ID
+		if role == roleTest && owner != "" && isDangling(tags[id]) {
+			if !dryRun {
+				output, err := removeImage(host, id)
+				if err != nil {
+					fmt.Printf("* **Failed** removing dangling %v image `%v`:\n\n```\n%v\n```\n\n", role, id, output)
+					errs++
+					continue
+				}
+			}
+			fmt.Printf("* %v dangling %v image of `%v` (`%v`)\n", verb, role, owner, id)
+			continue
+		}
+
+		wanted := make(map[string]bool)
+		for _, name := range expected {
+			wanted[withTag(name)] = true
+		}
+		for _, tag := range tags[id] {
+			if !wanted[tag] {
+				continue
+			}
+			if !dryRun {
+				output, err := removeImage(host, tag)
+				if err != nil {
+					fmt.Printf("* **Failed** removing %v image `%v` (`%v`):\n\n```\n%v\n```\n\n", role, tag, id, output)
+					errs++
+					continue
+				}
+			}
+			fmt.Printf("* %v %v image `%v` (`%v`)\n", verb, role, tag, id)
+		}
+	}
+	return
+}
+
+/*
+isDangling returns whether tags, every name an image is listed with, are only
+the `<none>:<none>` docker lists images without a name as
+*/
+func isDangling(tags []string) bool {
+	for _, tag := range tags {
+		if tag != danglingName {
+			return false
+		}
+	}
+	return len(tags) > 0
+}
+
+/*
+withTag returns name with the `latest` tag docker gives it if it doesn't have a
+tag of its own, which is how `docker images` lists it
+*/
+func withTag(name string) string {
+	if _, _, tag := splitReference(name); tag == "" && !strings.Contains(name, "@") {
+		return name + ":latest"
+	}
+	return name
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+cleanDocker is a docker that lists test images for `app` and `gone`, one of each
+tagged and one of each dangling, and logs every image it is asked to remove
+*/
+const cleanDocker = `#!/bin/sh
+case "$1" in
+images)
+	printf 'sha256:tagged\tapp-test0:latest\n'
+	printf 'sha256:dangling\t<none>:<none>\n'
+	printf 'sha256:other\t<none>:<none>\n'
+	printf 'sha256:unlabelled\t<none>:<none>\n'
+	;;
+inspect)
+	eval "id=\${$#}"
+	case "$id" in
+	sha256:other) echo '{"Labels":{"io.dante.role":"test","io.dante.image":"gone","io.dante.test.number":"0"}}' ;;
+	sha256:unlabelled) echo '{"Labels":{"io.dante.role":"test"}}' ;;
+	*) echo '{"Labels":{"io.dante.role":"test","io.dante.image":"app","io.dante.test.number":"0"}}' ;;
+	esac
+	;;
+rmi)
+	echo "$2" >> "$REMOVED"
+	;;
+esac
+`
+
+func TestCleanImagesDangling(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		references map[string][]string
+		expected   []string
+	}{
+		{"inventory", map[string][]string{"app": {"app"}}, []string{"app-test0:latest", "sha256:dangling"}},
+		{"no inventory", nil, []string{"app-test0:latest", "sha256:dangling", "sha256:other"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bin := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(bin, "docker"), []byte(cleanDocker), 0755); err != nil {
+				t.Fatal(err)
+			}
+			removed := filepath.Join(bin, "removed")
+			t.Setenv("PATH", bin+":/bin:/usr/bin")
+			t.Setenv("REMOVED", removed)
+
+			if errs := cleanImages(localHost, roleTest, "Removed", false, test.references); errs != 0 {
+				t.Errorf("expected no errors, got %v", errs)
+			}
+			contents, _ := ioutil.ReadFile(removed)
+			if got := strings.Fields(string(contents)); strings.Join(got, " ") != strings.Join(test.expected, " ") {
+				t.Errorf("expected %v to be removed, got %v", test.expected, got)
+			}
+		})
+	}
+}
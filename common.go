@@ -1,23 +1,193 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os/exec"
+	"strings"
 )
 
+/*
+The statuses a job can finish with
+*/
+const (
+	// statusPassed jobs did everything they set out to do
+	statusPassed = "passed"
+	// statusFailed jobs ran and failed
+	statusFailed = "failed"
+	// statusCancelled jobs were interrupted by --fail-fast while running
+	statusCancelled = "cancelled"
+	// statusSkipped jobs never started because --fail-fast had already
+	// stopped the run
+	statusSkipped = "skipped"
+)
+
+/*
+The states a job passes through while it runs, shown by the terminal UI. Once
+it has finished, a job's state is its status.
+*/
+const (
+	stateQueued   = "queued"
+	stateBuilding = "building"
+	stateTesting  = "testing"
+	statePushing  = "pushing"
+	stateRetrying = "retrying"
+)
+
+/*
+jobContext is shared by every docker command dante runs, so that cancelJobs
+can stop all of them at once when --fail-fast sees a failure
+*/
+var jobContext, cancelJobs = context.WithCancel(context.Background())
+
+/*
+errCancelled is wrapped by the errors of commands cancelJobs stopped, so jobs
+can tell being stopped by --fail-fast apart from failing on their own
+*/
+var errCancelled = errors.New("cancelled by --fail-fast")
+
+/*
+stoppedBy returns true if err is the error of a command that was killed because
+ctx ended. A command that exited with an error of its own failed by itself,
+even if ctx ended while it was failing.
+*/
+func stoppedBy(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() == nil {
+		return false
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	return !ok || !exitErr.Exited()
+}
+
 type ImageDefinition map[string]interface{}
 
 type Job struct {
-	Image   ImageDefinition
+	Image ImageDefinition
+	// Retries is the count passed with -r, which the image's inventory
+	// settings may override for each step, see getRetries
 	Retries int
-	Output  string
-	Success bool
-	Id      int
+	// RetryTests retries every failure of the image's tests with Retries,
+	// rather than only the transient ones, so flaky tests can be spotted
+	RetryTests bool
+	Output     string
+	Success    bool
+	Id         int
+	Registry   string
+	// Attest is the directory attestations are written to, or read from when
+	// attaching them to pushed images. Empty means no attestations.
+	Attest string
+	// SignKey is the private key pushed images are signed with. Empty means
+	// images aren't signed.
+	SignKey string
+	// Diff reports what changed in rebuilt images since their previous build
+	Diff bool
+	// Status is one of statusPassed, statusFailed, statusCancelled or
+	// statusSkipped once the job has finished
+	Status string
+	// Cancelled is set when the job failed because --fail-fast stopped it,
+	// rather than failing on its own
+	Cancelled bool
+	// Tests are the results of the image's Dockerfile tests
+	Tests []TestResult
+	// Priority orders jobs waiting for the scheduler, higher first
+	Priority int
+	// Host is the docker host the job runs on, see assignHosts
+	Host *dockerHost
+	// Log, if it is set, is handed the output of the job's builds and pushes
+	// a line at a time while they run
+	Log func(line string)
+	// State, if it is set, is told each time the job moves to a new state
+	State func(state string)
+	// Built, if it is set, is told whether the job's image built as soon as
+	// that is known, before its tests run
+	Built func(success bool)
+	// Run is set for jobs that run a single test, and is the image the test
+	// belongs to. Test and TestNum are the test and its index.
+	Run     *imageRun
+	Test    TestDefinition
+	TestNum int
+}
+
+/*
+setState tells whoever is following job, if anyone, that it is now in state
+*/
+func (job Job) setState(state string) {
+	if job.State != nil {
+		job.State(state)
+	}
+}
+
+/*
+built tells whoever is waiting on job's image, if anyone, whether it built
+*/
+func (job Job) built(success bool) {
+	if job.Built != nil {
+		job.Built(success)
+	}
+}
+
+/*
+retrying returns a function that marks job as retrying, for withRetries
+*/
+func (job Job) retrying() func() {
+	return func() {
+		job.setState(stateRetrying)
+	}
+}
+
+/*
+finishJob records the status of a job that has run, telling failures apart
+from jobs that only failed because they were cancelled. Jobs that failed on
+their own are failures even when they finish after the run was cancelled.
+*/
+func finishJob(job Job) Job {
+	switch {
+	case job.Success:
+		job.Status = statusPassed
+	case job.Cancelled:
+		job.Status = statusCancelled
+	default:
+		job.Status = statusFailed
+	}
+	return job
+}
+
+/*
+skipJob returns true, along with job marked as skipped, if the run has been
+cancelled before job could start
+*/
+func skipJob(job Job) (Job, bool) {
+	if jobContext.Err() == nil {
+		return job, false
+	}
+	job.Success = false
+	job.Status = statusSkipped
+	job.Output = fmt.Sprintf("# Skipped `%v`\n\nNot started since an earlier job failed with --fail-fast\n\n", job.Image["name"])
+	return job, true
+}
+
+/*
+summarizeJobs describes how many jobs finished with each status, such as
+`3 passed, 1 failed, 2 cancelled, 4 skipped`
+*/
+func summarizeJobs(statuses map[string]int) string {
+	summary := []string{}
+	for _, status := range []string{statusPassed, statusFailed, statusCancelled, statusSkipped} {
+		summary = append(summary, fmt.Sprintf("%v %v", statuses[status], status))
+	}
+	return strings.Join(summary, ", ")
 }
 
-func reporter(output chan Job, done chan bool) {
-	for {
-		tmp := <-output
-		fmt.Printf("%v", tmp.Output)
-		done <- tmp.Success
+/*
+reporter prints the output of every job as it finishes, unless quiet is set,
+and hands the job on to done
+*/
+func reporter(output chan Job, done chan Job, quiet bool) {
+	for tmp := range output {
+		if !quiet {
+			fmt.Printf("%v", tmp.Output)
+		}
+		done <- tmp
 	}
 }
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"github.com/retrohacker/cli"
+	"gopkg.in/yaml.v2"
 	"os"
+	"time"
 )
 
 const version string = "1.1.0"
@@ -12,6 +14,14 @@ const version string = "1.1.0"
 // We will initialize it once and then use it throughout the app
 var inventory Inventory
 
+// inventoryFlag lets every command point at an inventory file other than the
+// inventory.yml in the current working directory
+var inventoryFlag = cli.StringFlag{
+	Name:  "file,f",
+	Usage: "Path to the inventory file",
+	Value: "inventory.yml",
+}
+
 func main() {
 
 	/* Define cli commands and flags */
@@ -22,6 +32,19 @@ func main() {
 			Usage:  "Build images and run tests defined in inventory.yml",
 			Action: test,
 			Flags: []cli.Flag{
+				inventoryFlag,
+				cli.StringFlag{
+					Name:  "attest",
+					Usage: "Write provenance and SBOM attestations for each image into this directory",
+				},
+				cli.StringFlag{
+					Name:  "flaky-history",
+					Usage: "Record how often each test is flaky across runs in this file, retrying every test failure with -r",
+				},
+				cli.BoolFlag{
+					Name:  "diff",
+					Usage: "Report what changed in each rebuilt image since its previous build",
+				},
 				cli.IntFlag{
 					Name:  "retries,r",
 					Usage: "Retry on failure",
@@ -29,8 +52,90 @@ func main() {
 				},
 				cli.IntFlag{
 					Name:  "parallel,j",
-					Usage: "Run parallel jobs",
-					Value: 1,
+					Usage: "Run at most this many jobs in parallel, by default as many as the host has room for",
+				},
+				cli.IntFlag{
+					Name:  "max-builds",
+					Usage: "Run at most this many image builds at once",
+				},
+				cli.IntFlag{
+					Name:  "max-tests",
+					Usage: "Run at most this many images' tests at once",
+				},
+				cli.BoolFlag{
+					Name:  "fail-fast",
+					Usage: "Cancel every remaining job as soon as one fails",
+				},
+				cli.BoolFlag{
+					Name:  "keep-going",
+					Usage: "Run every job even after one fails (the default)",
+				},
+				cli.StringSliceFlag{
+					Name:  "remote",
+					Usage: "Run jobs on the `dante agent` at this URL instead of a docker host, may be given more than once",
+					Value: &cli.StringSlice{},
+				},
+				cli.StringFlag{
+					Name:  "remote-token",
+					Usage: "Token to send to the agents given with --remote, by default $DANTE_AGENT_TOKEN",
+				},
+			},
+		},
+		{
+			Name:   "watch",
+			Usage:  "Test images again whenever their files change",
+			Action: watch,
+			Flags: []cli.Flag{
+				inventoryFlag,
+				cli.StringFlag{
+					Name:  "interval",
+					Usage: "How often to look for changes",
+					Value: "1s",
+				},
+				cli.IntFlag{
+					Name:  "retries,r",
+					Usage: "Retry on failure",
+					Value: 0,
+				},
+				cli.IntFlag{
+					Name:  "parallel,j",
+					Usage: "Run at most this many jobs in parallel, by default as many as the host has room for",
+				},
+				cli.IntFlag{
+					Name:  "max-builds",
+					Usage: "Run at most this many image builds at once",
+				},
+				cli.IntFlag{
+					Name:  "max-tests",
+					Usage: "Run at most this many images' tests at once",
+				},
+			},
+		},
+		{
+			Name:   "agent",
+			Usage:  "Serve jobs sent by `dante test --remote`, building and testing them with the local docker",
+			Action: runAgentCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen,l",
+					Usage: "Address to accept jobs on, which must be a loopback address unless there is a token",
+					Value: "127.0.0.1:8377",
+				},
+				cli.StringFlag{
+					Name:  "token",
+					Usage: "Only accept jobs sent with this token, by default $DANTE_AGENT_TOKEN",
+				},
+				cli.IntFlag{
+					Name:  "parallel,j",
+					Usage: "Run at most this many jobs in parallel, by default one for each CPU",
+				},
+				cli.IntFlag{
+					Name:  "max-builds",
+					Usage: "Run at most this many image builds at once",
+				},
+				cli.IntFlag{
+					Name:  "max-tests",
+					Usage: "Run at most this many images' tests at once",
 				},
 			},
 		},
@@ -39,6 +144,15 @@ func main() {
 			Usage:  "Push local images to remote registry",
 			Action: push,
 			Flags: []cli.Flag{
+				inventoryFlag,
+				cli.StringFlag{
+					Name:  "attest",
+					Usage: "Attach the attestations written by test --attest in this directory to pushed images",
+				},
+				cli.StringFlag{
+					Name:  "sign-key",
+					Usage: "Sign pushed images with this PEM encoded ECDSA or ed25519 private key",
+				},
 				cli.IntFlag{
 					Name:  "retries,r",
 					Usage: "Retry on failure",
@@ -46,11 +160,109 @@ func main() {
 				},
 				cli.IntFlag{
 					Name:  "parallel,j",
-					Usage: "Run parallel jobs",
-					Value: 1,
+					Usage: "Run at most this many jobs in parallel, by default as many as the host has room for",
+				},
+				cli.IntFlag{
+					Name:  "max-pushes",
+					Usage: "Run at most this many pushes at once",
+					Value: 4,
+				},
+				cli.BoolFlag{
+					Name:  "fail-fast",
+					Usage: "Cancel every remaining job as soon as one fails",
+				},
+				cli.BoolFlag{
+					Name:  "keep-going",
+					Usage: "Run every job even after one fails (the default)",
+				},
+				cli.StringFlag{
+					Name:  "push-policy",
+					Usage: "Judge images with several registries as pushed when all or any of them succeed",
+					Value: pushPolicyAll,
+				},
+			},
+		},
+		{
+			Name:   "init",
+			Usage:  "Write an inventory.yml for the Dockerfiles in the current directory",
+			Action: initialize,
+			Flags: []cli.Flag{
+				inventoryFlag,
+				cli.StringFlag{
+					Name:  "namespace,n",
+					Usage: "Prefix proposed image names with a namespace, such as wblankenship/",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Overwrite an existing inventory file",
+				},
+			},
+		},
+		{
+			Name:   "graph",
+			Usage:  "Render how the images, tests and aliases in the inventory relate",
+			Action: graph,
+			Flags: []cli.Flag{
+				inventoryFlag,
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Output format: tree, dot or mermaid",
+					Value: "tree",
+				},
+				cli.BoolFlag{
+					Name:  "markdown",
+					Usage: "Wrap the graph in a fenced code block for embedding in markdown",
+				},
+			},
+		},
+		{
+			Name:   "clean",
+			Usage:  "Remove test images and temporary contexts left behind by dante",
+			Action: clean,
+			Flags: []cli.Flag{
+				inventoryFlag,
+				cli.BoolFlag{
+					Name:  "images",
+					Usage: "Also remove the images built from the inventory",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "List what would be removed without removing it",
 				},
 			},
 		},
+		{
+			Name:   "verify",
+			Usage:  "Verify the signatures of pushed images",
+			Action: verify,
+			Flags: []cli.Flag{
+				inventoryFlag,
+				cli.StringFlag{
+					Name:  "key,k",
+					Usage: "PEM encoded ECDSA or ed25519 public key the images must be signed with",
+				},
+			},
+		},
+		{
+			Name:   "diff",
+			Usage:  "Compare an image from the inventory with an earlier version of it",
+			Action: diff,
+			Flags: []cli.Flag{
+				inventoryFlag,
+				cli.StringFlag{
+					Name:  "against",
+					Usage: "Image reference or digest to compare against, instead of the previous build",
+				},
+			},
+		},
+		{
+			Name:   "config",
+			Usage:  "Print the fully resolved inventory",
+			Action: config,
+			Flags: []cli.Flag{
+				inventoryFlag,
+			},
+		},
 	}
 
 	app.Version = version
@@ -61,12 +273,12 @@ func main() {
 
 /*
 populateInventory initializes the global state of the application as directed
-by the user's inventory.yaml file
+by the user's inventory.yaml file, or the file passed with --file
 */
-func populateInventory() {
+func populateInventory(c *cli.Context) {
 	// Load the yml definition of images and tests
 	var err error
-	inventory, err = GetInventory()
+	inventory, err = GetInventory(c.String("file"))
 
 	if err != nil {
 		// If we can't find the inventory file, there is nothing left for us to do.
@@ -76,63 +288,311 @@ func populateInventory() {
 }
 
 func test(c *cli.Context) {
-	populateInventory()
+	populateInventory(c)
+	reportInventory(inventory)
 
 	opts := scrub_input(TestOpts{
-		Threads: c.Int("parallel"),
-		Retries: c.Int("retries"),
+		Threads:      c.Int("parallel"),
+		Retries:      c.Int("retries"),
+		Attest:       c.String("attest"),
+		Diff:         c.Bool("diff"),
+		FailFast:     failFast(c),
+		FlakyHistory: c.String("flaky-history"),
+		Inventory:    c.String("file"),
+		MaxBuilds:    c.Int("max-builds"),
+		MaxTests:     c.Int("max-tests"),
+		Remote:       c.StringSlice("remote"),
+		RemoteToken:  agentToken(c, "remote-token"),
 	})
 
+	// Attestations are written on the machine that built the image, which
+	// for an agent isn't this one
+	if len(opts.Remote) > 0 && opts.Attest != "" {
+		fmt.Printf("--attest can't be used with --remote\n")
+		os.Exit(1)
+	}
+
 	// Build the images and run the tests defined in the inventory file
-	errs := runTests(inventory, opts)
+	errs, statuses, _ := runTests(inventory, opts)
 
 	// Determine if the tests passed or failed
 	if errs > 0 {
 		// Not all tests passed, this makes docker-test a sad panda
-		fmt.Printf("# Conclusion\n\n%v tests failed.\n\n", errs)
+		fmt.Printf("# Conclusion\n\n%v tests failed.\n\nJobs: %v.\n\n", errs, summarizeJobs(statuses))
 		os.Exit(1)
 	}
-	// All tests and builds completed succesfully!
-	fmt.Printf("# Conclusion\n\nall tests passed.\n\n")
-
-	// Tag images with aliases
-	errs = runAlias(inventory)
-	if errs > 0 {
-		fmt.Printf("# Conclusion\n\n%v aliases failed.\n\n", errs)
-		os.Exit(1)
-	}
-
-	fmt.Printf("# Conclusion\n\nall aliases succeeded.\n\n", errs)
+	// All tests, builds and aliases completed succesfully!
+	fmt.Printf("# Conclusion\n\nall tests passed.\n\nJobs: %v.\n\n", summarizeJobs(statuses))
 	os.Exit(0)
 
 }
 
 func push(c *cli.Context) {
-	populateInventory()
+	populateInventory(c)
+	reportInventory(inventory)
 
 	opts := scrub_input(TestOpts{
-		Threads: c.Int("parallel"),
-		Retries: c.Int("retries"),
+		Threads:    c.Int("parallel"),
+		Retries:    c.Int("retries"),
+		PushPolicy: c.String("push-policy"),
+		Attest:     c.String("attest"),
+		SignKey:    c.String("sign-key"),
+		FailFast:   failFast(c),
+		MaxPushes:  c.Int("max-pushes"),
 	})
 
-	errs := runPushes(inventory, opts)
+	// Catch a bad key before anything is pushed, rather than once per image
+	if opts.SignKey != "" {
+		if _, err := loadSigningKey(opts.SignKey); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Make sure every policy we were handed is one we know how to apply
+	if !validPushPolicy(opts.PushPolicy) {
+		fmt.Printf("Unknown push policy `%v`\n", opts.PushPolicy)
+		os.Exit(1)
+	}
+	for _, image := range inventory["images"] {
+		if policy := getPushPolicy(image, opts); !validPushPolicy(policy) {
+			fmt.Printf("Unknown push policy `%v` for image `%v`\n", policy, image["name"])
+			os.Exit(1)
+		}
+	}
+
+	errs, statuses := runPushes(inventory, opts)
 
 	// Determine if the tests passed or failed
 	if errs > 0 {
 		// Not all tests passed, this makes docker-test a sad panda
-		fmt.Printf("# Conclusion\n\n%v pushes failed.\n\n", errs)
+		fmt.Printf("# Conclusion\n\n%v pushes failed.\n\nJobs: %v.\n\n", errs, summarizeJobs(statuses))
 		os.Exit(1)
 	} else {
 		// All tests and builds completed succesfully!
-		fmt.Printf("# Conclusion\n\nall pushes succeeded.\n\n")
+		fmt.Printf("# Conclusion\n\nall pushes succeeded.\n\nJobs: %v.\n\n", summarizeJobs(statuses))
 		os.Exit(0)
 	}
 
 }
 
+func watch(c *cli.Context) {
+	interval, err := time.ParseDuration(c.String("interval"))
+	if err != nil || interval <= 0 {
+		fmt.Printf("--interval must be a duration like `1s`\n")
+		os.Exit(1)
+	}
+	opts := scrub_input(TestOpts{
+		Threads:   c.Int("parallel"),
+		Retries:   c.Int("retries"),
+		MaxBuilds: c.Int("max-builds"),
+		MaxTests:  c.Int("max-tests"),
+	})
+	runWatch(c.String("file"), opts, interval)
+}
+
+func runAgentCommand(c *cli.Context) {
+	opts := scrub_input(TestOpts{
+		Threads:   c.Int("parallel"),
+		MaxBuilds: c.Int("max-builds"),
+		MaxTests:  c.Int("max-tests"),
+	})
+	err := runAgent(c.String("listen"), agentToken(c, "token"), opts)
+	fmt.Printf("%v\n", err)
+	os.Exit(1)
+}
+
+/*
+agentToken returns the token given with the flag called name, or the one in the
+environment if the flag wasn't given
+*/
+func agentToken(c *cli.Context, name string) string {
+	if token := c.String(name); token != "" {
+		return token
+	}
+	return os.Getenv(agentTokenEnv)
+}
+
+func initialize(c *cli.Context) {
+	err := initInventory(c.String("file"), c.String("namespace"), c.Bool("force"))
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func graph(c *cli.Context) {
+	populateInventory(c)
+
+	imageGraph, err := buildImageGraph(inventory)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	output, err := renderGraph(imageGraph, c.String("format"), c.Bool("markdown"))
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%v", output)
+}
+
+func clean(c *cli.Context) {
+	// Clean every host the inventory lists, or just the local one when there
+	// is no inventory to read them from
+	hosts := []*dockerHost{localHost}
+	var cleaning Inventory
+	if _, err := os.Stat(c.String("file")); err == nil {
+		populateInventory(c)
+		hosts = getHosts(inventory)
+		cleaning = inventory
+	}
+
+	errs := runClean(CleanOpts{
+		Images:    c.Bool("images"),
+		DryRun:    c.Bool("dry-run"),
+		Hosts:     hosts,
+		Inventory: cleaning,
+	})
+
+	if errs > 0 {
+		fmt.Printf("# Conclusion\n\n%v removals failed.\n\n", errs)
+		os.Exit(1)
+	}
+	fmt.Printf("# Conclusion\n\nclean.\n\n")
+}
+
+func verify(c *cli.Context) {
+	if c.String("key") == "" {
+		fmt.Printf("verify needs a public key, pass one with --key\n")
+		os.Exit(1)
+	}
+
+	// Verify the references named on the command line, or if there aren't
+	// any, everything push would have pushed for the inventory
+	refs := []string(c.Args())
+	if len(refs) == 0 {
+		populateInventory(c)
+		for _, image := range inventory["images"] {
+			for _, registry := range getPushDestinations(image) {
+				for _, ref := range getPushReferences(image) {
+					if registry != "" {
+						ref = registryReference(ref, registry)
+					}
+					refs = append(refs, ref)
+				}
+			}
+		}
+	}
+
+	fmt.Printf("# Verifying Signatures\n\n")
+	errs := 0
+	for _, ref := range refs {
+		output, err := verifyImage(ref, c.String("key"))
+		fmt.Printf("%v", output)
+		if err != nil {
+			errs++
+		}
+	}
+
+	if errs > 0 {
+		fmt.Printf("# Conclusion\n\n%v images failed verification.\n\n", errs)
+		os.Exit(1)
+	}
+	fmt.Printf("# Conclusion\n\nall signatures verified.\n\n")
+}
+
+func diff(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Printf("diff needs the name of an image from the inventory\n")
+		os.Exit(1)
+	}
+	populateInventory(c)
+
+	name := c.Args()[0]
+	found := false
+	for _, image := range inventory["images"] {
+		if image["name"] == name {
+			found = true
+		}
+	}
+	if !found {
+		fmt.Printf("`%v` isn't an image in the inventory\n", name)
+		os.Exit(1)
+	}
+
+	// The image and its earlier builds live on the host it is assigned to
+	host := assignHosts(inventory, getHosts(inventory))[name]
+
+	// Without --against, compare with whatever dante built before the
+	// image the name points at now
+	against := c.String("against")
+	if against == "" {
+		current, err := imageId(host, name)
+		if err != nil {
+			fmt.Printf("`%v` hasn't been built on host `%v`\n", name, host.Name)
+			os.Exit(1)
+		}
+		against, err = previousImage(host, name, current)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("# Diff of `%v`\n\n", name)
+	imageDiff, err := diffImages(host, against, name)
+	if err != nil {
+		fmt.Printf("**Failed** with error: `%v`\n\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%v", renderDiff(imageDiff, 0))
+}
+
+func config(c *cli.Context) {
+	populateInventory(c)
+
+	// Print the inventory exactly as the other commands will see it, once
+	// includes, inheritance, matrices and templates have all been applied,
+	// leaving out what dante only keeps for itself
+	public := Inventory{}
+	for section, entries := range inventory {
+		for _, entry := range entries {
+			copied := make(map[string]interface{})
+			for key, value := range entry {
+				copied[key] = value
+			}
+			for _, key := range internalKeys {
+				delete(copied, key)
+			}
+			public[section] = append(public[section], copied)
+		}
+	}
+	output, err := yaml.Marshal(public)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s", output)
+}
+
+/*
+failFast returns true if --fail-fast was passed. Keeping going is the default,
+--keep-going only exists to say so explicitly, so asking for both is an error.
+*/
+func failFast(c *cli.Context) bool {
+	if c.Bool("fail-fast") && c.Bool("keep-going") {
+		fmt.Printf("--fail-fast and --keep-going can't be used together\n")
+		os.Exit(1)
+	}
+	return c.Bool("fail-fast")
+}
+
 func scrub_input(opts TestOpts) TestOpts {
-	if opts.Threads < 1 {
-		opts.Threads = 1
+	// Zero threads leaves it to the scheduler
+	if opts.Threads < 0 {
+		opts.Threads = 0
 	}
 
 	if opts.Retries < 0 {
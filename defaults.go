@@ -0,0 +1,121 @@
+/*
+defaults.go contains the logic for images inheriting settings from the
+`defaults` block of an inventory file and from the images they `extends`
+*/
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+uninheritable lists the keys that always belong to a single image and are
+never copied from defaults or a parent image. Aliases are tags, which only one
+image can own.
+*/
+var uninheritable = map[string]bool{
+	"name":         true,
+	"alias":        true,
+	"extends":      true,
+	"source":       true,
+	"matrix_group": true,
+}
+
+/*
+inherit copies every key from parent into image that image doesn't set itself.
+Build args are merged key by key, so an image only has to list the args it
+wants to change.
+*/
+func inherit(image map[string]interface{}, parent map[string]interface{}) {
+	for key, value := range parent {
+		if uninheritable[key] {
+			continue
+		}
+		if key == "args" {
+			args := make(map[string]string)
+			for k, v := range getBuildArgs(parent) {
+				args[k] = v
+			}
+			for k, v := range getBuildArgs(image) {
+				args[k] = v
+			}
+			image[key] = args
+			continue
+		}
+		if _, ok := image[key]; !ok {
+			image[key] = value
+		}
+	}
+}
+
+/*
+applyInheritance resolves the `extends` key of every image, then fills in
+anything still missing from the defaults that apply to it. defaults holds the
+defaults for each image in images, in the same order. An image's own settings
+win over its parent's, which win over its defaults.
+*/
+func applyInheritance(images []map[string]interface{}, defaults []map[string]interface{}) (err error) {
+	// Index images by their name as written, which is what extends refers to
+	byName := make(map[string]int)
+	for i, image := range images {
+		if name, ok := image["name"].(string); ok {
+			byName[name] = i
+		}
+	}
+
+	// resolved marks images whose parents (and defaults) have been applied
+	resolved := make(map[int]bool)
+	var resolve func(i int, chain []string) error
+	resolve = func(i int, chain []string) error {
+		if resolved[i] {
+			return nil
+		}
+		image := images[i]
+		name, _ := image["name"].(string)
+
+		if _, ok := image["extends"]; ok {
+			parentName, ok := image["extends"].(string)
+			if !ok {
+				return fmt.Errorf("image `%v` has an extends that isn't a string", name)
+			}
+			for _, link := range chain {
+				if link == parentName {
+					return fmt.Errorf("image `%v` extends itself through `%v`", name, parentName)
+				}
+			}
+			parent, ok := byName[parentName]
+			if !ok {
+				return fmt.Errorf("image `%v` extends unknown image `%v`", name, parentName)
+			}
+			if err := resolve(parent, append(chain, name)); err != nil {
+				return err
+			}
+			inherit(image, images[parent])
+		}
+
+		if defaults[i] != nil {
+			inherit(image, defaults[i])
+		}
+		resolved[i] = true
+		return nil
+	}
+
+	for i := range images {
+		err = resolve(i, []string{})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+getTimeout returns how long a single docker command for an image may run before
+it is killed, from the image's `timeout` key. Zero means no limit.
+*/
+func getTimeout(image map[string]interface{}) time.Duration {
+	value, _ := image["timeout"].(string)
+	timeout, _ := time.ParseDuration(value)
+	return timeout
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyInheritance(t *testing.T) {
+	images := []map[string]interface{}{
+		{"name": "child", "extends": "parent", "args": map[string]string{"B": "child"}, "retries": 1},
+		{"name": "parent", "alias": "parent:latest", "args": map[string]string{"A": "parent", "B": "parent"}, "timeout": "5m", "retries": 2},
+		{"name": "other"},
+	}
+	defaults := []map[string]interface{}{
+		{"timeout": "1m", "cpus": 2},
+		nil,
+		{"timeout": "1m"},
+	}
+	if err := applyInheritance(images, defaults); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"name":    "child",
+		"extends": "parent",
+		"args":    map[string]string{"A": "parent", "B": "child"},
+		"retries": 1,
+		"timeout": "5m",
+		"cpus":    2,
+	}
+	if !reflect.DeepEqual(images[0], expected) {
+		t.Errorf("expected the child to be %v, got %v", expected, images[0])
+	}
+	if images[2]["timeout"] != "1m" {
+		t.Errorf("expected `other` to take its default timeout, got %v", images[2]["timeout"])
+	}
+}
+
+func TestApplyInheritanceErrors(t *testing.T) {
+	for _, test := range []struct {
+		images   []map[string]interface{}
+		expected string
+	}{
+		{[]map[string]interface{}{{"name": "a", "extends": "missing"}}, "extends unknown image `missing`"},
+		{[]map[string]interface{}{{"name": "a", "extends": 42}}, "has an extends that isn't a string"},
+		{[]map[string]interface{}{{"name": "a", "extends": "a"}}, "extends itself"},
+		{[]map[string]interface{}{{"name": "a", "extends": "b"}, {"name": "b", "extends": "a"}}, "extends itself"},
+	} {
+		err := applyInheritance(test.images, make([]map[string]interface{}, len(test.images)))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("applyInheritance(%v) = %v, expected an error containing %q", test.images, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+/*
+diff.go contains the logic for comparing two versions of an image, so it is
+clear what changed when an image is rebuilt
+*/
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+diffRow is a single thing that differs between two images
+*/
+type diffRow struct {
+	// Change is added, removed or modified
+	Change string
+	Name   string
+	Before string
+	After  string
+}
+
+/*
+ImageDiff is everything that differs between two images
+*/
+type ImageDiff struct {
+	Before   string
+	After    string
+	Files    []diffRow
+	Packages []diffRow
+	Env      []diffRow
+	Labels   []diffRow
+	Config   []diffRow
+}
+
+/*
+diffMaps compares two sets of named values, returning a row for each name that
+was added, removed or given a different value, sorted by name
+*/
+func diffMaps(before map[string]string, after map[string]string) (rows []diffRow) {
+	for name, value := range before {
+		afterValue, ok := after[name]
+		if !ok {
+			rows = append(rows, diffRow{Change: "removed", Name: name, Before: value})
+		} else if afterValue != value {
+			rows = append(rows, diffRow{Change: "modified", Name: name, Before: value, After: afterValue})
+		}
+	}
+	for name, value := range after {
+		if _, ok := before[name]; !ok {
+			rows = append(rows, diffRow{Change: "added", Name: name, After: value})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Name < rows[j].Name
+	})
+	return
+}
+
+/*
+imageFiles returns a description of every file in the image name, keyed by its
+path. Regular files are described by their size, mode and a digest of their
+contents, so any change to a file changes its description.
+*/
+func imageFiles(host *dockerHost, name string) (files map[string]string, err error) {
+	id, err := createContainer(host, name)
+	if err != nil {
+		return
+	}
+	defer removeContainer(host, id)
+
+	files = make(map[string]string)
+	err = exportContainer(host, id, func(reader io.Reader) error {
+		archive := tar.NewReader(reader)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			description := header.FileInfo().Mode().String()
+			switch header.Typeflag {
+			case tar.TypeReg:
+				hash := sha256.New()
+				if _, err := io.Copy(hash, archive); err != nil {
+					return err
+				}
+				description = fmt.Sprintf("%v %v %v", description, formatSize(header.Size), hex.EncodeToString(hash.Sum(nil))[:12])
+			case tar.TypeSymlink, tar.TypeLink:
+				description = fmt.Sprintf("%v -> %v", description, header.Linkname)
+			}
+			files[path.Join("/", header.Name)] = description
+		}
+	})
+	return
+}
+
+/*
+imagePackages returns the version of every package installed in the image name,
+keyed by the package's name
+*/
+func imagePackages(host *dockerHost, name string) (packages map[string]string, err error) {
+	listed, err := listPackages(host, name)
+	if err != nil {
+		return
+	}
+	packages = make(map[string]string)
+	for _, pkg := range listed {
+		packages[pkg.Name] = pkg.Version + " (" + pkg.Manager + ")"
+	}
+	return
+}
+
+/*
+configFields splits an image's configuration into its environment, its labels
+and everything else, each as a set of named values that can be compared
+*/
+func configFields(config imageConfig) (env map[string]string, labels map[string]string, fields map[string]string) {
+	env = make(map[string]string)
+	for _, variable := range config.Env {
+		pair := strings.SplitN(variable, "=", 2)
+		if len(pair) == 2 {
+			env[pair[0]] = pair[1]
+		}
+	}
+
+	labels = make(map[string]string)
+	for key, value := range config.Labels {
+		labels[key] = value
+	}
+
+	fields = make(map[string]string)
+	for key, value := range map[string]interface{}{
+		"User":         config.User,
+		"Entrypoint":   config.Entrypoint,
+		"Cmd":          config.Cmd,
+		"WorkingDir":   config.WorkingDir,
+		"ExposedPorts": config.ExposedPorts,
+		"Volumes":      config.Volumes,
+	} {
+		encoded, _ := json.Marshal(value)
+		fields[key] = string(encoded)
+	}
+	return
+}
+
+/*
+diffImages compares the images before and after, which may be names, ids or
+digests of images on host
+*/
+func diffImages(host *dockerHost, before string, after string) (diff ImageDiff, err error) {
+	diff.Before = before
+	diff.After = after
+
+	beforeFiles, err := imageFiles(host, before)
+	if err != nil {
+		return
+	}
+	afterFiles, err := imageFiles(host, after)
+	if err != nil {
+		return
+	}
+	diff.Files = diffMaps(beforeFiles, afterFiles)
+
+	// Images without a shell or package manager still have everything else
+	// compared, they just have no packages to compare
+	beforePackages, beforeErr := imagePackages(host, before)
+	afterPackages, afterErr := imagePackages(host, after)
+	if beforeErr == nil && afterErr == nil {
+		diff.Packages = diffMaps(beforePackages, afterPackages)
+	}
+
+	beforeConfig, err := inspectConfig(host, before)
+	if err != nil {
+		return
+	}
+	afterConfig, err := inspectConfig(host, after)
+	if err != nil {
+		return
+	}
+	beforeEnv, beforeLabels, beforeFields := configFields(beforeConfig)
+	afterEnv, afterLabels, afterFields := configFields(afterConfig)
+	diff.Env = diffMaps(beforeEnv, afterEnv)
+	diff.Labels = diffMaps(beforeLabels, afterLabels)
+	diff.Config = diffMaps(beforeFields, afterFields)
+	return
+}
+
+/*
+renderDiffRows renders one section of a diff as a markdown table, listing at
+most limit rows unless limit is zero
+*/
+func renderDiffRows(title string, rows []diffRow, limit int) (output string) {
+	output = fmt.Sprintf("### %v\n\n", title)
+	if len(rows) == 0 {
+		return output + fmt.Sprintf("No changes\n\n")
+	}
+
+	counts := make(map[string]int)
+	for _, row := range rows {
+		counts[row.Change]++
+	}
+	output = output + fmt.Sprintf("%v added, %v removed, %v modified\n\n", counts["added"], counts["removed"], counts["modified"])
+
+	output = output + fmt.Sprintf("| Change | Name | Before | After |\n")
+	output = output + fmt.Sprintf("|--------|------|--------|-------|\n")
+	for i, row := range rows {
+		if limit > 0 && i == limit {
+			output = output + fmt.Sprintf("\n... and %v more\n", len(rows)-limit)
+			break
+		}
+		output = output + fmt.Sprintf("| %v | `%v` | %v | %v |\n", row.Change, row.Name, diffValue(row.Before), diffValue(row.After))
+	}
+	return output + fmt.Sprintf("\n")
+}
+
+/*
+diffValue formats a value for a diff table, leaving missing values blank
+*/
+func diffValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "`" + strings.Replace(value, "|", "\\|", -1) + "`"
+}
+
+/*
+renderDiff renders diff as markdown, listing at most limit rows in each section
+unless limit is zero
+*/
+func renderDiff(diff ImageDiff, limit int) (output string) {
+	output = fmt.Sprintf("Comparing `%v` to `%v`\n\n", diff.Before, diff.After)
+	output = output + renderDiffRows("Files", diff.Files, limit)
+	output = output + renderDiffRows("Packages", diff.Packages, limit)
+	output = output + renderDiffRows("Env", diff.Env, limit)
+	output = output + renderDiffRows("Labels", diff.Labels, limit)
+	output = output + renderDiffRows("Config", diff.Config, limit)
+	return
+}
+
+/*
+previousImage returns the id of the newest image dante built for the inventory
+image name other than current, which is what an image is compared against when
+nothing else is asked for
+*/
+func previousImage(host *dockerHost, name string, current string) (id string, err error) {
+	images, err := listImages(host, labelRole+"="+roleImage, labelImage+"="+name)
+	if err != nil {
+		return
+	}
+	for _, image := range images {
+		if image.Id != current {
+			return image.Id, nil
+		}
+	}
+	return "", fmt.Errorf("there is no earlier build of `%v` on this host to compare against", name)
+}
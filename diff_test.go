@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffMaps(t *testing.T) {
+	for _, test := range []struct {
+		before   map[string]string
+		after    map[string]string
+		expected []diffRow
+	}{
+		{nil, nil, nil},
+		{map[string]string{"A": "1"}, map[string]string{"A": "1"}, nil},
+		{
+			map[string]string{"PATH": "/bin", "OLD": "x", "SAME": "y"},
+			map[string]string{"PATH": "/usr/bin:/bin", "NEW": "z", "SAME": "y"},
+			[]diffRow{
+				{Change: "added", Name: "NEW", After: "z"},
+				{Change: "removed", Name: "OLD", Before: "x"},
+				{Change: "modified", Name: "PATH", Before: "/bin", After: "/usr/bin:/bin"},
+			},
+		},
+		{map[string]string{}, map[string]string{"EMPTY": ""}, []diffRow{{Change: "added", Name: "EMPTY"}}},
+	} {
+		if rows := diffMaps(test.before, test.after); !reflect.DeepEqual(rows, test.expected) {
+			t.Errorf("diffMaps(%v, %v) = %v, expected %v", test.before, test.after, rows, test.expected)
+		}
+	}
+}
@@ -5,39 +5,155 @@ from inside the application
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 /*
-execDocker is a pretty wrapper around exec.Command("docker",...)
+execDocker is a pretty wrapper around exec.Command("docker",...), running
+command against the daemon on host
 */
-func execDocker(path string, command string, args ...string) (output string, err error) {
+func execDocker(host *dockerHost, path string, command string, args ...string) (output string, err error) {
+	return execDockerTimeout(host, 0, path, command, args...)
+}
+
+/*
+execDockerTimeout is execDocker for commands that should be killed if they run
+for longer than timeout. A timeout of zero lets the command run forever.
+*/
+func execDockerTimeout(host *dockerHost, timeout time.Duration, path string, command string, args ...string) (output string, err error) {
+	return execDockerLog(host, timeout, nil, path, command, args...)
+}
+
+/*
+execDockerLog is execDockerTimeout for commands whose output is also handed to
+log a line at a time while they run, so long builds can be followed as they
+happen. A nil log only collects the output.
+*/
+func execDockerLog(host *dockerHost, timeout time.Duration, log func(line string), path string, command string, args ...string) (output string, err error) {
+	return runDocker(jobContext, host, timeout, log, path, command, args...)
+}
+
+/*
+execDockerCleanup is execDocker for commands that clean up or finish what other
+commands started, such as rolling back aliases. They aren't stopped by
+--fail-fast, since stopping them part way would leave a mess behind.
+*/
+func execDockerCleanup(host *dockerHost, path string, command string, args ...string) (output string, err error) {
+	return runDocker(context.Background(), host, 0, nil, path, command, args...)
+}
+
+/*
+runDocker runs docker with command and args against host, stopping it when
+parent ends or timeout passes. Commands stopped by the end of jobContext
+return an error wrapping errCancelled.
+*/
+func runDocker(parent context.Context, host *dockerHost, timeout time.Duration, log func(line string), path string, command string, args ...string) (output string, err error) {
 	// Hold the output from our command
 	var outputBytes []byte
 
 	// First, we create an array with command and args to pass to exec
-	tmp := []string{command}
+	tmp := append(host.args(), command)
 	for _, arg := range args {
 		tmp = append(tmp, arg)
 	}
 
+	ctx := parent
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	// Next, we build and execute the command
-	cmd := exec.Command("docker", tmp...)
+	cmd := exec.CommandContext(ctx, "docker", tmp...)
 
 	cmd.Dir, err = filepath.Abs(path)
 	if err != nil {
 		return
 	}
 
-	outputBytes, err = cmd.CombinedOutput()
-	output = string(outputBytes)
+	if log == nil {
+		outputBytes, err = cmd.CombinedOutput()
+		output = string(outputBytes)
+	} else {
+		writer := &lineWriter{log: log}
+		cmd.Stdout = writer
+		cmd.Stderr = writer
+		err = cmd.Run()
+		writer.flush()
+		output = writer.output.String()
+	}
+	if stoppedBy(parent, err) {
+		err = fmt.Errorf("docker %v %w", command, errCancelled)
+	} else if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("docker %v timed out after %v", command, timeout)
+	}
 
 	return
 }
 
 type DockerOpts struct {
-	Cache bool
+	Cache     bool
+	BuildArgs map[string]string
+	Labels    map[string]string
+	Timeout   time.Duration
+	// Host is the docker daemon the image is built on or pushed from
+	Host *dockerHost
+	// Log is handed each line of output as docker prints it, if it is set
+	Log func(line string)
+}
+
+/*
+lineWriter collects everything written to it, handing each complete line to log
+as it arrives
+*/
+type lineWriter struct {
+	mutex  sync.Mutex
+	output bytes.Buffer
+	// partial holds the start of a line that hasn't been finished yet
+	partial []byte
+	log     func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.output.Write(p)
+	w.partial = append(w.partial, p...)
+	for {
+		end := bytes.IndexByte(w.partial, '\n')
+		if end < 0 {
+			break
+		}
+		w.log(string(w.partial[:end]))
+		w.partial = w.partial[end+1:]
+	}
+	return len(p), nil
+}
+
+/*
+flush hands log whatever was written after the last newline
+*/
+func (w *lineWriter) flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.partial) > 0 {
+		w.log(string(w.partial))
+		w.partial = nil
+	}
 }
 
 /*
@@ -53,20 +169,256 @@ func buildImage(name string, path string, opts DockerOpts) (output string, err e
 		args = append(args, "--no-cache")
 	}
 
+	// Pass build args in a stable order so the command is reproducible
+	keys := []string{}
+	for key := range opts.BuildArgs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--build-arg", key+"="+opts.BuildArgs[key])
+	}
+
+	keys = []string{}
+	for key := range opts.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--label", key+"="+opts.Labels[key])
+	}
+
 	// local directory
 	args = append(args, ".")
 
-	return execDocker(path, "build", args...)
+	return execDockerLog(opts.Host, opts.Timeout, opts.Log, path, "build", args...)
 }
 
 /*
 pushImage will take a docker image and push it to a remote registry. It captures
 stdout and stderr returning them both in output
 */
-func pushImage(name string) (output string, err error) {
-	return execDocker("/", "push", name)
+func pushImage(name string, opts DockerOpts) (output string, err error) {
+	return execDockerLog(opts.Host, opts.Timeout, opts.Log, "/", "push", name)
+}
+
+/*
+pushDigestPattern matches the line docker push ends with, which names the
+digest of the manifest it pushed
+*/
+var pushDigestPattern = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64})`)
+
+/*
+pushedDigest returns the digest of the manifest pushed for name, which is what
+a registry knows the image as. It is read from output, the log of the push, or
+failing that from the repo digests docker recorded for the image.
+*/
+func pushedDigest(host *dockerHost, name string, output string) (digest string, err error) {
+	if matches := pushDigestPattern.FindAllStringSubmatch(output, -1); len(matches) > 0 {
+		return matches[len(matches)-1][1], nil
+	}
+
+	registry, repository, _ := splitReference(name)
+	if registry != "" {
+		repository = registry + "/" + repository
+	}
+	digests, err := execDocker(host, "/", "inspect", "--type", "image", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", name)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", err, digests)
+	}
+	for _, line := range strings.Split(digests, "\n") {
+		if parts := strings.SplitN(strings.TrimSpace(line), "@", 2); len(parts) == 2 && parts[0] == repository {
+			return parts[1], nil
+		}
+	}
+	return "", fmt.Errorf("docker doesn't know the digest `%v` was pushed as", name)
+}
+
+/*
+dockerAlias tags the image name with alias. It captures stdout and stderr
+returning them both in output.
+*/
+func dockerAlias(host *dockerHost, name string, alias string) (output string, err error) {
+	return execDockerCleanup(host, "/", "tag", name, alias)
+}
+
+/*
+imageId returns the id of the image that name currently refers to. It returns
+an error if docker does not know about an image called name.
+*/
+func imageId(host *dockerHost, name string) (id string, err error) {
+	id, err = execDockerCleanup(host, "/", "inspect", "--type", "image", "--format", "{{.Id}}", name)
+	id = strings.TrimSpace(id)
+	return
+}
+
+/*
+dockerImage is an image on the host as listed by `docker images`
+*/
+type dockerImage struct {
+	Id   string
+	Name string
+}
+
+/*
+listImages returns the ids and names of the images on host with every one
+of the label filters, such as `io.dante.role=test`, newest first. Images
+without a name, like the ones left dangling when a tag is built again, are
+named `<none>:<none>`.
+*/
+func listImages(host *dockerHost, filters ...string) (images []dockerImage, err error) {
+	var output string
+	args := []string{"--no-trunc", "--format", "{{.ID}}\t{{.Repository}}:{{.Tag}}"}
+	for _, filter := range filters {
+		args = append(args, "--filter", "label="+filter)
+	}
+	output, err = execDocker(host, "/", "images", args...)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", err, output)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) == 2 {
+			images = append(images, dockerImage{Id: fields[0], Name: fields[1]})
+		}
+	}
+	return
+}
+
+/*
+removeImage removes the tag name from the host. The underlying image is only
+deleted by docker once nothing else refers to it. It captures stdout and stderr
+returning them both in output.
+*/
+func removeImage(host *dockerHost, name string) (output string, err error) {
+	return execDockerCleanup(host, "/", "rmi", name)
+}
+
+/*
+imageLayer is a single entry in the history of an image, as listed by
+`docker history`
+*/
+type imageLayer struct {
+	// Size is the size of the layer in bytes
+	Size int64
+	// CreatedBy is the instruction that created the layer
+	CreatedBy string
+}
+
+/*
+imageHistory returns the layers of the image name, oldest first
+*/
+func imageHistory(host *dockerHost, name string) (layers []imageLayer, err error) {
+	var output string
+	output, err = execDocker(host, "/", "history", "--no-trunc", "--human=false", "--format", "{{.Size}}\t{{.CreatedBy}}", name)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", err, output)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	// docker lists the newest layer first
+	for i := len(lines) - 1; i >= 0; i-- {
+		fields := strings.SplitN(lines[i], "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[0], 10, 64)
+		layers = append(layers, imageLayer{Size: size, CreatedBy: fields[1]})
+	}
+	return
+}
+
+/*
+pullImage pulls the image name onto host. It captures stdout and stderr
+returning them both in output.
+*/
+func pullImage(host *dockerHost, name string) (output string, err error) {
+	return execDocker(host, "/", "pull", name)
+}
+
+/*
+imageSize returns the size in bytes of the image name and the number of
+filesystem layers it is made of
+*/
+func imageSize(host *dockerHost, name string) (size int64, layers int, err error) {
+	var output string
+	output, err = execDocker(host, "/", "inspect", "--type", "image", "--format", "{{.Size}} {{len .RootFS.Layers}}", name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%v: %v", err, output)
+	}
+	_, err = fmt.Sscan(output, &size, &layers)
+	return
+}
+
+/*
+createContainer creates, without starting, a container from the image name and
+returns its id. docker refuses to create a container without a command, and
+images built FROM scratch often have none, so it is given one that never runs.
+*/
+func createContainer(host *dockerHost, name string) (id string, err error) {
+	id, err = execDocker(host, "/", "create", name, "true")
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", err, id)
+	}
+	id = strings.TrimSpace(id)
+	return
 }
 
-func dockerAlias(name string, alias string) (output string, err error) {
-	return execDocker("/", "tag", "-f", name, alias)
+/*
+removeContainer removes the container id
+*/
+func removeContainer(host *dockerHost, id string) (output string, err error) {
+	return execDockerCleanup(host, "/", "rm", "-f", id)
+}
+
+/*
+exportContainer streams the filesystem of the container id as a tar archive to
+read, which is too large to hold in memory the way execDocker does
+*/
+func exportContainer(host *dockerHost, id string, read func(io.Reader) error) (err error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(jobContext, "docker", append(host.args(), "export", id)...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	readErr := read(stdout)
+	// Drain anything read left behind so docker can exit
+	io.Copy(ioutil.Discard, stdout)
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return readErr
+}
+
+/*
+imageConfig is the part of an image's configuration that decides how its
+containers run
+*/
+type imageConfig struct {
+	User         string
+	Env          []string
+	Entrypoint   []string
+	Cmd          []string
+	WorkingDir   string
+	ExposedPorts map[string]interface{}
+	Volumes      map[string]interface{}
+	Labels       map[string]string
+}
+
+/*
+inspectConfig returns the configuration of the image name
+*/
+func inspectConfig(host *dockerHost, name string) (config imageConfig, err error) {
+	output, err := execDocker(host, "/", "inspect", "--type", "image", "--format", "{{json .Config}}", name)
+	if err != nil {
+		return config, fmt.Errorf("%v: %v", err, output)
+	}
+	err = json.Unmarshal([]byte(output), &config)
+	return
 }
@@ -0,0 +1,180 @@
+/*
+dockerfile.go contains the logic for reading Dockerfiles into the instructions
+they are made of
+*/
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+Instruction is a single instruction from a Dockerfile, such as
+`RUN apt-get update`
+*/
+type Instruction struct {
+	// Line is the line number the instruction starts on
+	Line int
+	// Command is the instruction's keyword in upper case, such as RUN
+	Command string
+	// Args is everything after the command, with line continuations joined
+	Args string
+}
+
+/*
+parseDockerfile reads the Dockerfile in the directory dir and returns the
+instructions it contains. Comments and blank lines are dropped, and
+instructions split over several lines with a trailing `\` are joined into one.
+*/
+func parseDockerfile(dir string) (instructions []Instruction, err error) {
+	file, err := os.Open(filepath.Join(dir, "Dockerfile"))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	var current *Instruction
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Comments and blank lines are allowed even in the middle of a continued
+		// instruction, and never contribute to it
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		continued := strings.HasSuffix(line, "\\")
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\\"))
+
+		if current == nil {
+			fields := strings.SplitN(line, " ", 2)
+			current = &Instruction{
+				Line:    lineNum,
+				Command: strings.ToUpper(fields[0]),
+			}
+			if len(fields) > 1 {
+				current.Args = strings.TrimSpace(fields[1])
+			}
+		} else if line != "" {
+			current.Args = strings.TrimSpace(current.Args + " " + line)
+		}
+
+		if !continued {
+			instructions = append(instructions, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		instructions = append(instructions, *current)
+	}
+	err = scanner.Err()
+	return
+}
+
+/*
+dockerfileBase returns the image the final stage of a Dockerfile is built
+from, following `FROM <stage>` references back through earlier stages of a
+multi-stage build. It returns the empty string if the Dockerfile has no FROM,
+which is how the Dockerfiles for tests are written.
+*/
+func dockerfileBase(instructions []Instruction) (base string) {
+	stages := make(map[string]string)
+	for _, instruction := range instructions {
+		if instruction.Command != "FROM" {
+			continue
+		}
+
+		fields := fromFields(instruction.Args)
+		if len(fields) == 0 {
+			continue
+		}
+
+		base = fields[0]
+		if stageBase, ok := stages[strings.ToLower(base)]; ok {
+			base = stageBase
+		}
+		if len(fields) == 3 && strings.ToUpper(fields[1]) == "AS" {
+			stages[strings.ToLower(fields[2])] = base
+		}
+	}
+	return
+}
+
+/*
+fromFields splits the arguments of a FROM instruction into `image [AS name]`,
+dropping flags like --platform
+*/
+func fromFields(args string) (fields []string) {
+	for _, field := range strings.Fields(args) {
+		if !strings.HasPrefix(field, "--") {
+			fields = append(fields, field)
+		}
+	}
+	return
+}
+
+/*
+dockerfileArgPattern matches `$NAME` and `${NAME}` references to build args
+*/
+var dockerfileArgPattern = regexp.MustCompile(`\$(\w+)|\$\{(\w+)\}`)
+
+/*
+expandBuildArgs replaces references to build args in text, such as the
+`node:${NODE_VERSION}` in a FROM line, with their values from args. References
+to args that aren't set are left alone.
+*/
+func expandBuildArgs(text string, args map[string]string) string {
+	return dockerfileArgPattern.ReplaceAllStringFunc(text, func(ref string) string {
+		match := dockerfileArgPattern.FindStringSubmatch(ref)
+		name := match[1] + match[2]
+		if value, ok := args[name]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+/*
+imageBase returns the image that an image from the inventory is built FROM,
+with any build args it references filled in
+*/
+func imageBase(image map[string]interface{}) (base string, err error) {
+	path, _ := image["path"].(string)
+	instructions, err := parseDockerfile(path)
+	if err != nil {
+		return
+	}
+	base = expandBuildArgs(dockerfileBase(instructions), fromArgs(instructions, image))
+	return
+}
+
+/*
+fromArgs returns the build args available to the FROM lines of a Dockerfile:
+the defaults of the ARGs declared before the first FROM, overridden by the
+image's args
+*/
+func fromArgs(instructions []Instruction, image map[string]interface{}) map[string]string {
+	args := make(map[string]string)
+	for _, instruction := range instructions {
+		if instruction.Command == "FROM" {
+			break
+		}
+		if instruction.Command == "ARG" {
+			pair := strings.SplitN(instruction.Args, "=", 2)
+			if len(pair) == 2 {
+				args[strings.TrimSpace(pair[0])] = strings.Trim(strings.TrimSpace(pair[1]), `"'`)
+			}
+		}
+	}
+	for key, value := range getBuildArgs(image) {
+		args[key] = value
+	}
+	return args
+}
@@ -0,0 +1,178 @@
+/*
+flaky.go contains the logic for spotting tests that only pass some of the time,
+both within a single run and across the history of runs
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+The results a Dockerfile test can have
+*/
+const (
+	// testPassed tests passed on their first attempt
+	testPassed = "passed"
+	// testFlaky tests passed, but only after being retried
+	testFlaky = "flaky"
+	// testFailed tests failed every attempt
+	testFailed = "failed"
+)
+
+/*
+TestResult is the outcome of running one Dockerfile test against an image
+*/
+type TestResult struct {
+	Image      string
+	Test       string
+	Attempts   int
+	Quarantine bool
+	// Status is testPassed, testFlaky or testFailed
+	Status string
+}
+
+/*
+TestHistory is what is known about a single test from earlier runs
+*/
+type TestHistory struct {
+	Runs      int    `json:"runs"`
+	Flaky     int    `json:"flaky"`
+	Failed    int    `json:"failed"`
+	LastFlaky string `json:"last_flaky,omitempty"`
+}
+
+/*
+FlakyHistory is the contents of the history file, keyed by testKey
+*/
+type FlakyHistory map[string]*TestHistory
+
+/*
+testKey identifies a test across runs by its image and its path relative to
+root, the directory of the inventory file, so that the history still applies
+when the inventory is checked out somewhere else
+*/
+func testKey(result TestResult, root string) string {
+	return result.Image + " " + testPath(result.Test, root)
+}
+
+/*
+testPath returns the path of a test relative to root, when it is inside root
+*/
+func testPath(path string, root string) string {
+	if root == "" || !filepath.IsAbs(path) {
+		return path
+	}
+	relative, err := filepath.Rel(root, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.ToSlash(relative)
+}
+
+/*
+loadFlakyHistory reads the history file at path. A history file that doesn't
+exist yet is an empty history.
+*/
+func loadFlakyHistory(path string) (history FlakyHistory, err error) {
+	history = make(FlakyHistory)
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(contents, &history)
+	if err != nil {
+		err = fmt.Errorf("could not read flaky test history `%v`: %v", path, err)
+	}
+	return
+}
+
+/*
+saveFlakyHistory writes history to path, replacing the file in one step so an
+interrupted run can't leave it half written
+*/
+func saveFlakyHistory(path string, history FlakyHistory) (err error) {
+	contents, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".dante-flaky")
+	if err != nil {
+		return
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(append(contents, '\n'))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+/*
+recordTests adds the results of this run to history, keyed relative to root
+*/
+func recordTests(history FlakyHistory, results []TestResult, root string) {
+	for _, result := range results {
+		key := testKey(result, root)
+		entry, ok := history[key]
+		if !ok {
+			entry = &TestHistory{}
+			history[key] = entry
+		}
+		entry.Runs++
+		switch result.Status {
+		case testFlaky:
+			entry.Flaky++
+			entry.LastFlaky = time.Now().UTC().Format(time.RFC3339)
+		case testFailed:
+			entry.Failed++
+		}
+	}
+}
+
+/*
+reportFlaky prints the tests that were flaky or quarantined in this run, along
+with how often each has been flaky across every recorded run. history may be
+nil if no history is kept. Tests are shown relative to root.
+*/
+func reportFlaky(results []TestResult, history FlakyHistory, root string) {
+	notable := []TestResult{}
+	for _, result := range results {
+		if result.Status == testFlaky || result.Quarantine {
+			notable = append(notable, result)
+		}
+	}
+	if len(notable) == 0 {
+		return
+	}
+	sort.SliceStable(notable, func(i, j int) bool {
+		return testKey(notable[i], root) < testKey(notable[j], root)
+	})
+
+	fmt.Printf("# Flaky Tests\n\n| Image | Test | Attempts | Result | Quarantined | History |\n|---|---|---|---|---|---|\n")
+	for _, result := range notable {
+		quarantined := ""
+		if result.Quarantine {
+			quarantined = "yes"
+		}
+		past := ""
+		if entry, ok := history[testKey(result, root)]; ok {
+			past = fmt.Sprintf("flaky %v, failed %v of %v runs", entry.Flaky, entry.Failed, entry.Runs)
+		}
+		fmt.Printf("| `%v` | `%v` | %v | %v | %v | %v |\n", result.Image, testPath(result.Test, root), result.Attempts, result.Status, quarantined, past)
+	}
+	fmt.Printf("\n")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTestKey(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		root     string
+		expected string
+	}{
+		{"/repo/tests/http", "/repo", "app tests/http"},
+		{"/repo/images/app/tests/http", "/repo", "app images/app/tests/http"},
+		{"/elsewhere/tests/http", "/repo", "app /elsewhere/tests/http"},
+		{"/repository/tests/http", "/repo", "app /repository/tests/http"},
+		{"/repo/tests/http", "", "app /repo/tests/http"},
+		{"tests/http", "/repo", "app tests/http"},
+	} {
+		key := testKey(TestResult{Image: "app", Test: test.path}, test.root)
+		if key != test.expected {
+			t.Errorf("testKey of %q under %q = %q, expected %q", test.path, test.root, key, test.expected)
+		}
+	}
+}
+
+func TestTestKeyMovedCheckout(t *testing.T) {
+	// The same test in two checkouts of the repository shares its history
+	history := make(FlakyHistory)
+	recordTests(history, []TestResult{{Image: "app", Test: "/ci/one/tests/http", Status: testFlaky}}, "/ci/one")
+	recordTests(history, []TestResult{{Image: "app", Test: "/ci/two/tests/http", Status: testPassed}}, "/ci/two")
+	entry, ok := history["app tests/http"]
+	if !ok || len(history) != 1 {
+		t.Fatalf("expected a single entry for `app tests/http`, got %v", history)
+	}
+	if entry.Runs != 2 || entry.Flaky != 1 {
+		t.Errorf("expected 2 runs with 1 flaky, got %v runs with %v flaky", entry.Runs, entry.Flaky)
+	}
+}
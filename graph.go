@@ -0,0 +1,280 @@
+/*
+graph.go contains all of the logic specific to the graph command, which renders
+how the images, tests and aliases in an inventory relate to each other
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+imageGraph holds the relationships between the images of an inventory
+*/
+type imageGraph struct {
+	// Images holds every image in the inventory, in inventory order
+	Images []ImageDefinition
+	// Parents maps each image name to the image it is built FROM
+	Parents map[string]string
+	// Children maps each image name, or external base, to the inventory images
+	// built FROM it
+	Children map[string][]string
+	// External holds the base images that aren't built by the inventory, sorted
+	External []string
+	// Roots holds the inventory images whose base couldn't be determined, or
+	// that are built FROM an earlier build of themselves
+	Roots []string
+}
+
+/*
+buildImageGraph reads the Dockerfile of every image in inventory to find the
+image it is built FROM. Names are compared the way docker sees them, so `FROM
+base:latest` or `FROM docker.io/library/base` is built FROM an image called
+`base`. A FROM line naming one of an image's aliases counts as that image,
+while an image FROM its own name builds on whatever that tag was before, so it
+is a root rather than its own parent.
+*/
+func buildImageGraph(inventory Inventory) (graph imageGraph, err error) {
+	graph.Parents = make(map[string]string)
+	graph.Children = make(map[string][]string)
+
+	names := make(map[string]string)
+	aliases := make(map[string]string)
+	for _, image := range inventory["images"] {
+		name := image["name"].(string)
+		names[normalizeName(name)] = name
+		for _, alias := range getAliasArray(image) {
+			aliases[normalizeName(alias)] = name
+		}
+	}
+
+	external := make(map[string]bool)
+	for _, image := range inventory["images"] {
+		graph.Images = append(graph.Images, image)
+		name := image["name"].(string)
+
+		var base string
+		base, err = imageBase(image)
+		if err != nil {
+			return graph, fmt.Errorf("could not read the Dockerfile for `%v`: %v", name, err)
+		}
+		if owner, ok := names[normalizeName(base)]; ok {
+			base = owner
+		} else if owner, ok := aliases[normalizeName(base)]; ok {
+			base = owner
+		}
+		if base == "" || base == name {
+			graph.Roots = append(graph.Roots, name)
+			continue
+		}
+
+		graph.Parents[name] = base
+		graph.Children[base] = append(graph.Children[base], name)
+		if names[normalizeName(base)] == "" && !external[base] {
+			external[base] = true
+			graph.External = append(graph.External, base)
+		}
+	}
+	sort.Strings(graph.External)
+	return
+}
+
+/*
+normalizeName returns the image name name the way docker sees it, without the
+docker hub prefixes docker fills in and with the `latest` tag docker fills in,
+so that names meaning the same image compare equal
+*/
+func normalizeName(name string) string {
+	for _, prefix := range []string{"docker.io/", "index.docker.io/"} {
+		if strings.HasPrefix(name, prefix) {
+			name = strings.TrimPrefix(name[len(prefix):], "library/")
+			break
+		}
+	}
+	if name == "" {
+		return name
+	}
+	return withTag(strings.TrimPrefix(name, "library/"))
+}
+
+/*
+testImageName returns the name of the image built for the test at index
+testNum (counting from zero) of the image called name
+*/
+func testImageName(name string, testNum int) string {
+	return name + "-test" + strconv.Itoa(testNum+1)
+}
+
+/*
+graphTree renders graph as a plain text tree, with every external base image
+at the root and the images built FROM it nested beneath. Images that are part
+of a cycle are drawn once, and marked where the cycle leads back to them.
+*/
+func graphTree(graph imageGraph) string {
+	images := make(map[string]ImageDefinition)
+	for _, image := range graph.Images {
+		images[image["name"].(string)] = image
+	}
+
+	var out string
+	visited := make(map[string]bool)
+	var render func(name string, prefix string)
+	render = func(name string, prefix string) {
+		visited[name] = true
+		image := images[name]
+		lines := []string{}
+		for i, test := range getTestArray(image) {
+			lines = append(lines, fmt.Sprintf("test: %v (%v)", testImageName(name, i), test))
+		}
+		for _, alias := range getAliasArray(image) {
+			lines = append(lines, "alias: "+alias)
+		}
+		children := graph.Children[name]
+		for i, line := range lines {
+			branch := "├── "
+			if i == len(lines)-1 && len(children) == 0 {
+				branch = "└── "
+			}
+			out = out + prefix + branch + line + "\n"
+		}
+		for i, child := range children {
+			branch, next := "├── ", "│   "
+			if i == len(children)-1 {
+				branch, next = "└── ", "    "
+			}
+			if visited[child] {
+				out = out + prefix + branch + child + " (cycle)\n"
+				continue
+			}
+			out = out + prefix + branch + child + "\n"
+			render(child, prefix+next)
+		}
+	}
+
+	for _, base := range graph.External {
+		out = out + base + " (external)\n"
+		for i, child := range graph.Children[base] {
+			branch, next := "├── ", "│   "
+			if i == len(graph.Children[base])-1 {
+				branch, next = "└── ", "    "
+			}
+			if visited[child] {
+				out = out + branch + child + " (cycle)\n"
+				continue
+			}
+			out = out + branch + child + "\n"
+			render(child, next)
+		}
+	}
+	for _, root := range graph.Roots {
+		out = out + root + "\n"
+		render(root, "")
+	}
+
+	// Images built FROM each other in a cycle can't be reached from an
+	// external base or a root, so start from the first of them
+	for _, image := range graph.Images {
+		name := image["name"].(string)
+		if !visited[name] {
+			out = out + name + "\n"
+			render(name, "")
+		}
+	}
+	return out
+}
+
+/*
+graphDot renders graph in graphviz's DOT language. External base images are
+drawn dashed, tests as notes and aliases as ellipses.
+*/
+func graphDot(graph imageGraph) string {
+	out := "digraph dante {\n\trankdir=LR;\n\tnode [shape=box];\n"
+	for _, base := range graph.External {
+		out = out + fmt.Sprintf("\t%q [style=dashed, label=%q];\n", base, base+" (external)")
+	}
+	for _, image := range graph.Images {
+		name := image["name"].(string)
+		out = out + fmt.Sprintf("\t%q;\n", name)
+		if parent, ok := graph.Parents[name]; ok {
+			out = out + fmt.Sprintf("\t%q -> %q;\n", parent, name)
+		}
+		for i, test := range getTestArray(image) {
+			testName := testImageName(name, i)
+			out = out + fmt.Sprintf("\t%q [shape=note, label=%q];\n", testName, testName+"\n"+test)
+			out = out + fmt.Sprintf("\t%q -> %q [label=\"test\"];\n", name, testName)
+		}
+		for _, alias := range getAliasArray(image) {
+			out = out + fmt.Sprintf("\t%q [shape=ellipse];\n", alias)
+			out = out + fmt.Sprintf("\t%q -> %q [style=dotted, label=\"alias\"];\n", name, alias)
+		}
+	}
+	return out + "}\n"
+}
+
+/*
+graphMermaid renders graph as a mermaid flowchart, which GitHub renders when it
+is embedded in markdown. Mermaid ids can't contain the characters used in image
+names, so every node is given a numbered id and labelled with its name.
+*/
+func graphMermaid(graph imageGraph) string {
+	ids := make(map[string]string)
+	id := func(name string) string {
+		if _, ok := ids[name]; !ok {
+			ids[name] = "n" + strconv.Itoa(len(ids))
+		}
+		return ids[name]
+	}
+	label := func(text string) string {
+		return strings.Replace(text, "\"", "#quot;", -1)
+	}
+
+	out := "graph LR\n"
+	for _, base := range graph.External {
+		out = out + fmt.Sprintf("\t%v[\"%v (external)\"]:::external\n", id(base), label(base))
+	}
+	for _, image := range graph.Images {
+		name := image["name"].(string)
+		out = out + fmt.Sprintf("\t%v[\"%v\"]\n", id(name), label(name))
+		if parent, ok := graph.Parents[name]; ok {
+			out = out + fmt.Sprintf("\t%v --> %v\n", id(parent), id(name))
+		}
+		for i, test := range getTestArray(image) {
+			testName := testImageName(name, i)
+			out = out + fmt.Sprintf("\t%v>\"%v<br/>%v\"]\n", id(testName), label(testName), label(test))
+			out = out + fmt.Sprintf("\t%v -- test --> %v\n", id(name), id(testName))
+		}
+		for _, alias := range getAliasArray(image) {
+			out = out + fmt.Sprintf("\t%v([\"%v\"])\n", id(alias), label(alias))
+			out = out + fmt.Sprintf("\t%v -. alias .-> %v\n", id(name), id(alias))
+		}
+	}
+	return out + "\tclassDef external stroke-dasharray: 5 5\n"
+}
+
+/*
+renderGraph renders graph in format, one of `tree`, `dot` or `mermaid`. When
+markdown is true the graph is wrapped in a fenced code block so it can be
+embedded in a report.
+*/
+func renderGraph(graph imageGraph, format string, markdown bool) (out string, err error) {
+	language := format
+	switch format {
+	case "tree":
+		out = graphTree(graph)
+		language = "text"
+	case "dot":
+		out = graphDot(graph)
+	case "mermaid":
+		out = graphMermaid(graph)
+	default:
+		return "", fmt.Errorf("unknown graph format `%v`, expected tree, dot or mermaid", format)
+	}
+
+	if markdown {
+		out = fmt.Sprintf("```%v\n%v```\n", language, out)
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"base":                               "base:latest",
+		"base:latest":                        "base:latest",
+		"base:1":                             "base:1",
+		"library/base":                       "base:latest",
+		"docker.io/library/base":             "base:latest",
+		"docker.io/base:2":                   "base:2",
+		"index.docker.io/library/base":       "base:latest",
+		"docker.io/wblankenship/test":        "wblankenship/test:latest",
+		"wblankenship/test:1":                "wblankenship/test:1",
+		"registry.example.com:5000/test":     "registry.example.com:5000/test:latest",
+		"registry.example.com/test@sha256:0": "registry.example.com/test@sha256:0",
+		"":                                   "",
+	} {
+		if normalized := normalizeName(name); normalized != expected {
+			t.Errorf("normalizeName(%q) = %q, expected %q", name, normalized, expected)
+		}
+	}
+}
+
+func TestBuildImageGraph(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		images   []testImage
+		aliases  map[string][]string
+		parents  map[string]string
+		external []string
+		roots    []string
+	}{
+		{
+			name:     "plain names",
+			images:   []testImage{{name: "base", from: "alpine"}, {name: "child", from: "base"}},
+			parents:  map[string]string{"base": "alpine", "child": "base"},
+			external: []string{"alpine"},
+		},
+		{
+			name:     "tagged FROM",
+			images:   []testImage{{name: "base", from: "alpine:3"}, {name: "child", from: "base:latest"}},
+			parents:  map[string]string{"base": "alpine:3", "child": "base"},
+			external: []string{"alpine:3"},
+		},
+		{
+			name:     "tagged name",
+			images:   []testImage{{name: "base:latest", from: "alpine"}, {name: "child", from: "base"}},
+			parents:  map[string]string{"base:latest": "alpine", "child": "base:latest"},
+			external: []string{"alpine"},
+		},
+		{
+			name:     "docker hub FROM",
+			images:   []testImage{{name: "base", from: "alpine"}, {name: "child", from: "docker.io/library/base"}},
+			parents:  map[string]string{"base": "alpine", "child": "base"},
+			external: []string{"alpine"},
+		},
+		{
+			name:     "other tag",
+			images:   []testImage{{name: "base", from: "alpine"}, {name: "child", from: "base:2"}},
+			parents:  map[string]string{"base": "alpine", "child": "base:2"},
+			external: []string{"alpine", "base:2"},
+		},
+		{
+			name:     "alias",
+			images:   []testImage{{name: "base:1", from: "alpine"}, {name: "child", from: "base"}},
+			aliases:  map[string][]string{"base:1": {"base:latest"}},
+			parents:  map[string]string{"base:1": "alpine", "child": "base:1"},
+			external: []string{"alpine"},
+		},
+		{
+			name:     "own name",
+			images:   []testImage{{name: "base", from: "base:latest"}},
+			parents:  map[string]string{},
+			external: nil,
+			roots:    []string{"base"},
+		},
+		{
+			name:     "scratch",
+			images:   []testImage{{name: "static", from: "scratch"}},
+			parents:  map[string]string{"static": "scratch"},
+			external: []string{"scratch"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			inventory := writeInventory(t, test.images)
+			for _, image := range inventory["images"] {
+				if aliases, ok := test.aliases[image["name"].(string)]; ok {
+					image["alias"] = stringsToInterfaces(aliases)
+				}
+			}
+			graph, err := buildImageGraph(inventory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(graph.Parents, test.parents) {
+				t.Errorf("parents %v, expected %v", graph.Parents, test.parents)
+			}
+			if !reflect.DeepEqual(graph.External, test.external) {
+				t.Errorf("external %v, expected %v", graph.External, test.external)
+			}
+			if !reflect.DeepEqual(graph.Roots, test.roots) {
+				t.Errorf("roots %v, expected %v", graph.Roots, test.roots)
+			}
+		})
+	}
+}
+
+func TestGraphTree(t *testing.T) {
+	inventory := writeInventory(t, []testImage{
+		{name: "base", from: "alpine"},
+		{name: "child", from: "base:latest"},
+		{name: "loop1", from: "loop2"},
+		{name: "loop2", from: "loop1"},
+	})
+	inventory["images"][0]["test"] = []interface{}{"tests/base"}
+	inventory["images"][1]["alias"] = []interface{}{"child:1"}
+	graph, err := buildImageGraph(inventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "alpine (external)\n" +
+		"└── base\n" +
+		"    ├── test: base-test1 (tests/base)\n" +
+		"    └── child\n" +
+		"        └── alias: child:1\n" +
+		"loop1\n" +
+		"└── loop2\n" +
+		"    └── loop1 (cycle)\n"
+	if tree := graphTree(graph); tree != expected {
+		t.Errorf("expected\n%v\ngot\n%v", expected, tree)
+	}
+}
+
+/*
+stringsToInterfaces returns values the way YAML decodes a list of strings
+*/
+func stringsToInterfaces(values []string) (out []interface{}) {
+	for _, value := range values {
+		out = append(out, value)
+	}
+	return
+}
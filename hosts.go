@@ -0,0 +1,248 @@
+/*
+hosts.go contains the logic for spreading jobs across several docker hosts,
+keeping every image on the same host as the images it is built FROM
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+dockerHost is a docker daemon that dante can build, test and push images on
+*/
+type dockerHost struct {
+	Name string
+	// URL is a DOCKER_HOST style address, such as tcp://builder1:2376
+	URL string
+	// Context is the name of a docker context, used instead of URL
+	Context string
+	// Agent is the address of a `dante agent` that runs jobs on its own
+	// docker host, used instead of either of the above
+	Agent string
+	// Token is sent to the agent with every job, if it is set
+	Token string
+}
+
+/*
+localHost is whichever docker daemon the environment points at, which is used
+when the inventory doesn't list any hosts
+*/
+var localHost = &dockerHost{Name: "local"}
+
+/*
+args returns the global flags that point docker at host
+*/
+func (host *dockerHost) args() []string {
+	switch {
+	case host.URL != "":
+		return []string{"--host", host.URL}
+	case host.Context != "":
+		return []string{"--context", host.Context}
+	}
+	return nil
+}
+
+/*
+env returns the environment for tools other than docker, such as scanners,
+that should talk to the daemon on host
+*/
+func (host *dockerHost) env() []string {
+	env := os.Environ()
+	switch {
+	case host.URL != "":
+		env = append(env, "DOCKER_HOST="+host.URL)
+	case host.Context != "":
+		env = append(env, "DOCKER_CONTEXT="+host.Context)
+	}
+	return env
+}
+
+/*
+hostEntry converts an entry of the inventory's `hosts` key to a map. A plain
+string is the URL of a host, and is used as its name too.
+*/
+func hostEntry(entry interface{}) map[string]interface{} {
+	if url, ok := entry.(string); ok {
+		return map[string]interface{}{"name": url, "host": url}
+	}
+	fields, ok := yamlMap(entry)
+	if !ok {
+		return map[string]interface{}{"invalid": entry}
+	}
+	if _, ok := fields["name"]; !ok {
+		if url, ok := fields["host"].(string); ok {
+			fields["name"] = url
+		} else if context, ok := fields["context"].(string); ok {
+			fields["name"] = context
+		}
+	}
+	return fields
+}
+
+/*
+verifyHost returns a description of what is wrong with an entry of the
+inventory's `hosts` key, or the empty string if nothing is
+*/
+func verifyHost(fields map[string]interface{}) string {
+	if _, ok := fields["invalid"]; ok {
+		return "isn't a URL or a map"
+	}
+	if name, ok := fields["name"].(string); !ok || name == "" {
+		return "has a name that isn't a string"
+	}
+	for key := range fields {
+		switch key {
+		case "name", "host", "context", "source":
+		default:
+			return fmt.Sprintf("has an unknown key `%v`", key)
+		}
+	}
+	url, hasURL := fields["host"].(string)
+	context, hasContext := fields["context"].(string)
+	if hasURL == hasContext || url == "" && context == "" {
+		return "needs exactly one of `host` or `context`"
+	}
+	return ""
+}
+
+/*
+getHosts returns the docker hosts listed in the inventory, or just localHost if
+there aren't any
+*/
+func getHosts(inventory Inventory) (hosts []*dockerHost) {
+	for _, fields := range inventory["hosts"] {
+		host := &dockerHost{}
+		host.Name, _ = fields["name"].(string)
+		host.URL, _ = fields["host"].(string)
+		host.Context, _ = fields["context"].(string)
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		hosts = []*dockerHost{localHost}
+	}
+	return
+}
+
+/*
+assignHosts decides which of hosts each image in inventory runs on. An image
+needs the image it is built FROM on the same host, so every image built from the
+same inventory image, directly or not, shares a host. Those families of images
+are spread over the hosts so each has a similar share of the work, largest
+family first. The same inventory and hosts always give the same assignment,
+which lets push find images on the host test built them on.
+*/
+func assignHosts(inventory Inventory, hosts []*dockerHost) (assigned map[string]*dockerHost) {
+	assigned = make(map[string]*dockerHost)
+	names := make(map[string]bool)
+	for _, image := range inventory["images"] {
+		names[image["name"].(string)] = true
+	}
+
+	// Without a graph, every image is a family of its own
+	parents := make(map[string]string)
+	if graph, err := buildImageGraph(inventory); err == nil {
+		parents = graph.Parents
+	}
+	family := func(name string) string {
+		seen := make(map[string]bool)
+		for names[parents[name]] && !seen[name] {
+			seen[name] = true
+			name = parents[name]
+		}
+		return name
+	}
+
+	var families []string
+	members := make(map[string][]string)
+	weights := make(map[string]float64)
+	for _, image := range inventory["images"] {
+		name := image["name"].(string)
+		root := family(name)
+		if _, ok := members[root]; !ok {
+			families = append(families, root)
+		}
+		members[root] = append(members[root], name)
+		weights[root] += getResources(image).CPUs
+	}
+	sort.SliceStable(families, func(i, j int) bool {
+		return weights[families[i]] > weights[families[j]]
+	})
+
+	load := make(map[*dockerHost]float64)
+	for _, root := range families {
+		least := hosts[0]
+		for _, host := range hosts {
+			if load[host] < load[least] {
+				least = host
+			}
+		}
+		load[least] += weights[root]
+		for _, name := range members[root] {
+			assigned[name] = least
+		}
+	}
+	return
+}
+
+/*
+reportHosts prints which images run on each host, when there is more than one
+*/
+func reportHosts(inventory Inventory, hosts []*dockerHost, assigned map[string]*dockerHost) {
+	if len(hosts) < 2 {
+		return
+	}
+	fmt.Printf("# Hosts\n\n| Host | Address | Images |\n|---|---|---|\n")
+	for _, host := range hosts {
+		images := []string{}
+		for _, image := range inventory["images"] {
+			if assigned[image["name"].(string)] == host {
+				images = append(images, "`"+image["name"].(string)+"`")
+			}
+		}
+		address := host.URL
+		if host.Context != "" {
+			address = "context " + host.Context
+		} else if host.Agent != "" {
+			address = "agent " + host.Agent
+		}
+		fmt.Printf("| `%v` | %v | %v |\n", host.Name, address, strings.Join(images, ", "))
+	}
+	fmt.Printf("\n")
+}
+
+/*
+newHostSchedulers creates a scheduler for each of hosts, since each has its own
+CPUs and memory. limits apply to each host separately. Agents schedule the jobs
+they are sent themselves, so they don't get one.
+*/
+func newHostSchedulers(hosts []*dockerHost, limits map[string]int) (scheds map[*dockerHost]*scheduler) {
+	scheds = make(map[*dockerHost]*scheduler)
+	for _, host := range hosts {
+		if host.Agent == "" {
+			capacity, err := hostCapacity(host)
+			scheds[host] = newScheduler(capacity, limits)
+			scheds[host].err = err
+		}
+	}
+	return
+}
+
+/*
+reportSchedulers prints what each of hosts has room for
+*/
+func reportSchedulers(hosts []*dockerHost, scheds map[*dockerHost]*scheduler) {
+	for _, host := range hosts {
+		if len(hosts) > 1 {
+			fmt.Printf("Host `%v`: ", host.Name)
+		}
+		if scheds[host] == nil {
+			fmt.Printf("jobs are scheduled by the agent\n\n")
+			continue
+		}
+		fmt.Printf("%v", scheds[host].describe())
+	}
+}
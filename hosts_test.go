@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/*
+testImage is an inventory image for a test, built FROM from
+*/
+type testImage struct {
+	name string
+	from string
+	cpus int
+}
+
+/*
+writeInventory writes a Dockerfile for each of images to a temporary directory,
+and returns an inventory listing them in order
+*/
+func writeInventory(t *testing.T, images []testImage) Inventory {
+	dir := t.TempDir()
+	inventory := Inventory{"images": {}}
+	for _, image := range images {
+		path := filepath.Join(dir, image.name)
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, "Dockerfile"), []byte("FROM "+image.from+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entry := map[string]interface{}{"name": image.name, "path": path}
+		if image.cpus > 0 {
+			entry["cpus"] = image.cpus
+		}
+		inventory["images"] = append(inventory["images"], entry)
+	}
+	return inventory
+}
+
+func testHosts() []*dockerHost {
+	return []*dockerHost{
+		{Name: "one", URL: "tcp://one:2376"},
+		{Name: "two", URL: "tcp://two:2376"},
+	}
+}
+
+func TestAssignHostsKeepsFamiliesTogether(t *testing.T) {
+	inventory := writeInventory(t, []testImage{
+		{name: "grandchild", from: "child"},
+		{name: "base", from: "alpine"},
+		{name: "child", from: "base"},
+		{name: "other", from: "alpine"},
+	})
+	assigned := assignHosts(inventory, testHosts())
+
+	for _, name := range []string{"child", "grandchild"} {
+		if assigned[name] != assigned["base"] {
+			t.Errorf("`%v` is on `%v` but the image it is built FROM is on `%v`", name, assigned[name].Name, assigned["base"].Name)
+		}
+	}
+	if assigned["other"] == assigned["base"] {
+		t.Errorf("`other` shares `%v` with `base` while the other host is idle", assigned["other"].Name)
+	}
+}
+
+func TestAssignHostsTaggedFrom(t *testing.T) {
+	inventory := writeInventory(t, []testImage{
+		{name: "base", from: "alpine"},
+		{name: "child", from: "base:latest"},
+		{name: "hub", from: "docker.io/library/base"},
+		{name: "other", from: "alpine"},
+	})
+	assigned := assignHosts(inventory, testHosts())
+
+	for _, name := range []string{"child", "hub"} {
+		if assigned[name] != assigned["base"] {
+			t.Errorf("`%v` is on `%v` but the image it is built FROM is on `%v`", name, assigned[name].Name, assigned["base"].Name)
+		}
+	}
+	parents := buildParents(inventory, map[string]bool{"base": true, "child": true, "hub": true})
+	if expected := map[string]string{"child": "base", "hub": "base"}; !reflect.DeepEqual(parents, expected) {
+		t.Errorf("expected %v to wait for `base`, got %v", expected, parents)
+	}
+}
+
+func TestAssignHostsBalancesWork(t *testing.T) {
+	inventory := writeInventory(t, []testImage{
+		{name: "small1", from: "alpine", cpus: 1},
+		{name: "small2", from: "alpine", cpus: 1},
+		{name: "large", from: "alpine", cpus: 4},
+		{name: "small3", from: "alpine", cpus: 1},
+		{name: "medium", from: "alpine", cpus: 2},
+	})
+	hosts := testHosts()
+	assigned := assignHosts(inventory, hosts)
+
+	load := make(map[*dockerHost]float64)
+	for _, image := range inventory["images"] {
+		load[assigned[image["name"].(string)]] += getResources(image).CPUs
+	}
+	if load[hosts[0]] != 5 || load[hosts[1]] != 4 {
+		t.Errorf("expected the hosts to have 5 and 4 CPUs of work, got %v and %v", load[hosts[0]], load[hosts[1]])
+	}
+	if assigned["large"] == assigned["medium"] {
+		t.Errorf("`large` and `medium` are both on `%v`", assigned["large"].Name)
+	}
+}
+
+func TestAssignHostsIsDeterministic(t *testing.T) {
+	inventory := writeInventory(t, []testImage{
+		{name: "a", from: "alpine"},
+		{name: "b", from: "alpine"},
+		{name: "c", from: "a"},
+		{name: "d", from: "debian"},
+		{name: "e", from: "alpine"},
+		{name: "f", from: "d"},
+	})
+	hosts := testHosts()
+
+	names := func(assigned map[string]*dockerHost) map[string]string {
+		out := make(map[string]string)
+		for image, host := range assigned {
+			out[image] = host.Name
+		}
+		return out
+	}
+	first := names(assignHosts(inventory, hosts))
+	for i := 0; i < 20; i++ {
+		if again := names(assignHosts(inventory, hosts)); !reflect.DeepEqual(first, again) {
+			t.Fatalf("the same inventory was assigned differently: %v then %v", first, again)
+		}
+	}
+}
+
+func TestAssignHostsSingleHost(t *testing.T) {
+	inventory := writeInventory(t, []testImage{
+		{name: "a", from: "alpine"},
+		{name: "b", from: "a"},
+	})
+	assigned := assignHosts(inventory, []*dockerHost{localHost})
+	for name, host := range assigned {
+		if host != localHost {
+			t.Errorf("`%v` was assigned to `%v` rather than the only host", name, host.Name)
+		}
+	}
+}
+
+func TestHostEntry(t *testing.T) {
+	for _, test := range []struct {
+		entry    interface{}
+		expected map[string]interface{}
+	}{
+		{"tcp://builder:2376", map[string]interface{}{"name": "tcp://builder:2376", "host": "tcp://builder:2376"}},
+		{map[interface{}]interface{}{"host": "tcp://builder:2376"}, map[string]interface{}{"name": "tcp://builder:2376", "host": "tcp://builder:2376"}},
+		{map[interface{}]interface{}{"context": "remote"}, map[string]interface{}{"name": "remote", "context": "remote"}},
+		{map[interface{}]interface{}{"name": "builder", "host": "tcp://builder:2376"}, map[string]interface{}{"name": "builder", "host": "tcp://builder:2376"}},
+		{42, map[string]interface{}{"invalid": 42}},
+	} {
+		if fields := hostEntry(test.entry); !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("hostEntry(%#v) = %v, expected %v", test.entry, fields, test.expected)
+		}
+	}
+}
+
+func TestVerifyHost(t *testing.T) {
+	for _, test := range []struct {
+		fields   map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"name": "builder", "host": "tcp://builder:2376"}, ""},
+		{map[string]interface{}{"name": "builder", "context": "remote"}, ""},
+		{map[string]interface{}{"name": "builder", "host": "tcp://builder:2376", "source": "ci"}, ""},
+		{map[string]interface{}{"invalid": 42}, "isn't a URL or a map"},
+		{map[string]interface{}{"host": "tcp://builder:2376"}, "has a name that isn't a string"},
+		{map[string]interface{}{"name": 42, "host": "tcp://builder:2376"}, "has a name that isn't a string"},
+		{map[string]interface{}{"name": "builder", "host": "tcp://builder:2376", "port": 2376}, "has an unknown key `port`"},
+		{map[string]interface{}{"name": "builder"}, "needs exactly one of `host` or `context`"},
+		{map[string]interface{}{"name": "builder", "host": "tcp://builder:2376", "context": "remote"}, "needs exactly one of `host` or `context`"},
+		{map[string]interface{}{"name": "builder", "host": ""}, "needs exactly one of `host` or `context`"},
+	} {
+		if problem := verifyHost(test.fields); problem != test.expected {
+			t.Errorf("verifyHost(%v) = %q, expected %q", test.fields, problem, test.expected)
+		}
+	}
+}
+
+func TestHostCapacityUnreachable(t *testing.T) {
+	// A docker that can't reach any daemon
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho 'Cannot connect to the Docker daemon' >&2\nexit 1\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	capacity, err := hostCapacity(&dockerHost{Name: "gone", URL: "tcp://gone:2376"})
+	if err == nil {
+		t.Fatal("expected an error for a host that can't be reached")
+	}
+	if capacity.CPUs != 1 {
+		t.Errorf("expected a single CPU for a host that can't be reached, got %v", capacity.CPUs)
+	}
+}
@@ -0,0 +1,365 @@
+/*
+init.go contains all of the logic specific to the init command, which writes an
+inventory.yml for the Dockerfiles found in a project
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+discoveredImage is an image proposed by init for a directory with a Dockerfile
+*/
+type discoveredImage struct {
+	// Path is the directory containing the Dockerfile, relative to the root
+	Path string
+	// Name is the name init proposes for the image
+	Name string
+	// Repository is the repository part of Name, used to match tests to images
+	Repository string
+	// Base is the image the Dockerfile is built FROM
+	Base string
+	// Tests holds the test directories that belong to this image
+	Tests []string
+}
+
+/*
+testDirNames are the directory names that hold tests
+*/
+var testDirNames = map[string]bool{
+	"test":  true,
+	"tests": true,
+	"spec":  true,
+}
+
+/*
+invalidRepositoryChars and invalidTagChars match the characters docker does not
+accept in the repository and tag parts of an image name
+*/
+var invalidRepositoryChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+/*
+findDockerfiles walks root and returns every directory (relative to root) that
+contains a Dockerfile. Hidden directories, including the temporary contexts
+dante creates while testing, are skipped.
+*/
+func findDockerfiles(root string) (dirs []string, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == "Dockerfile" {
+			rel, err := filepath.Rel(root, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, rel)
+		}
+		return nil
+	})
+	sort.Strings(dirs)
+	return
+}
+
+/*
+proposeName turns the path of a directory containing a Dockerfile into an image
+name. The last two directories become the repository and tag, and the
+directory before those becomes a variant on the tag, so
+`debian/jessie/node/0.12.0` is proposed as `node:0.12.0-jessie`.
+*/
+func proposeName(dir string, root string, namespace string) (name string, repository string) {
+	components := strings.Split(filepath.ToSlash(dir), "/")
+	if dir == "." {
+		abs, _ := filepath.Abs(root)
+		components = []string{filepath.Base(abs)}
+	}
+
+	tag := ""
+	repository = components[len(components)-1]
+	if len(components) >= 2 {
+		repository = components[len(components)-2]
+		tag = components[len(components)-1]
+	}
+	if len(components) >= 3 {
+		tag = tag + "-" + components[len(components)-3]
+	}
+
+	repository = invalidRepositoryChars.ReplaceAllString(strings.ToLower(repository), "-")
+	tag = invalidTagChars.ReplaceAllString(tag, "-")
+
+	name = namespace + repository
+	if tag != "" {
+		name = name + ":" + tag
+	}
+	return
+}
+
+/*
+isTestDir returns true if dir is inside of a directory used to hold tests
+*/
+func isTestDir(dir string) bool {
+	for _, component := range strings.Split(filepath.ToSlash(dir), "/") {
+		if testDirNames[component] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+assignTest finds the images a test directory belongs to. A test nested inside
+of an image's directory belongs to that image. Otherwise the images next to the
+test directory are candidates: if there is only one, it gets the test, else the
+test goes to the images whose repository matches the test's directory name
+(`tests/node` and `tests/node12` both belong to `node`).
+*/
+func assignTest(test string, images []*discoveredImage) (owners []*discoveredImage) {
+	slashed := filepath.ToSlash(test)
+
+	// Tests nested inside an image belong to the innermost such image
+	var nested *discoveredImage
+	for _, image := range images {
+		prefix := filepath.ToSlash(image.Path) + "/"
+		if image.Path == "." || strings.HasPrefix(slashed, prefix) {
+			if nested == nil || len(image.Path) > len(nested.Path) {
+				nested = image
+			}
+		}
+	}
+	if nested != nil && nested.Path != "." {
+		return []*discoveredImage{nested}
+	}
+
+	// Find the directory holding the tests directory, its images are our
+	// candidates
+	components := strings.Split(slashed, "/")
+	parent := ""
+	for i, component := range components {
+		if testDirNames[component] {
+			parent = strings.Join(components[:i], "/")
+			break
+		}
+	}
+	candidates := []*discoveredImage{}
+	for _, image := range images {
+		path := filepath.ToSlash(image.Path)
+		if !isTestDir(image.Path) && (parent == "" || path == parent || strings.HasPrefix(path, parent+"/")) {
+			candidates = append(candidates, image)
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates
+	}
+
+	base := strings.ToLower(components[len(components)-1])
+	for _, image := range candidates {
+		if strings.HasPrefix(base, image.Repository) || strings.HasPrefix(image.Repository, base) {
+			owners = append(owners, image)
+		}
+	}
+	return
+}
+
+/*
+sortByParent orders images so that every image comes after the image it is
+built FROM, keeping the original order otherwise.
+*/
+func sortByParent(images []*discoveredImage) (sorted []*discoveredImage) {
+	byName := make(map[string]*discoveredImage)
+	for _, image := range images {
+		byName[image.Name] = image
+	}
+	visited := make(map[*discoveredImage]bool)
+	var visit func(image *discoveredImage)
+	visit = func(image *discoveredImage) {
+		if visited[image] {
+			return
+		}
+		visited[image] = true
+		if parent, ok := byName[image.Base]; ok {
+			visit(parent)
+		}
+		sorted = append(sorted, image)
+	}
+	for _, image := range images {
+		visit(image)
+	}
+	return
+}
+
+/*
+discoverInventory walks root for Dockerfiles and proposes an image for each of
+them, along with the tests that belong to each image. Dockerfiles without a FROM
+are tests, since dante builds them FROM the image they test. Tests that can't
+be matched to an image are returned in unassigned.
+*/
+func discoverInventory(root string, namespace string) (images []*discoveredImage, unassigned []string, err error) {
+	dirs, err := findDockerfiles(root)
+	if err != nil {
+		return
+	}
+
+	tests := []string{}
+	names := make(map[string]bool)
+	for _, dir := range dirs {
+		var instructions []Instruction
+		instructions, err = parseDockerfile(filepath.Join(root, dir))
+		if err != nil {
+			return
+		}
+		base := dockerfileBase(instructions)
+		if base == "" {
+			tests = append(tests, dir)
+			continue
+		}
+
+		name, repository := proposeName(dir, root, namespace)
+		if names[name] {
+			// Fall back to the whole path when the short name is taken
+			repository = invalidRepositoryChars.ReplaceAllString(strings.ToLower(filepath.ToSlash(dir)), "-")
+			name = namespace + repository
+		}
+		names[name] = true
+
+		images = append(images, &discoveredImage{
+			Path:       dir,
+			Name:       name,
+			Repository: repository,
+			Base:       base,
+		})
+	}
+
+	for _, test := range tests {
+		owners := assignTest(test, images)
+		if len(owners) == 0 {
+			unassigned = append(unassigned, test)
+		}
+		for _, owner := range owners {
+			owner.Tests = append(owner.Tests, test)
+		}
+	}
+
+	images = sortByParent(images)
+	return
+}
+
+/*
+relativePath formats a path relative to the inventory file the way paths are
+written in inventory.yml
+*/
+func relativePath(path string) string {
+	if path == "." {
+		return "."
+	}
+	return "./" + filepath.ToSlash(path)
+}
+
+/*
+renderDiscoveredInventory writes the proposed images out as a commented
+inventory.yml
+*/
+func renderDiscoveredInventory(images []*discoveredImage, unassigned []string) string {
+	names := make(map[string]bool)
+	for _, image := range images {
+		names[image.Name] = true
+	}
+
+	out := "# inventory.yml generated by `dante init`\n"
+	out = out + "#\n"
+	out = out + "# Image names were proposed from the directory structure, review them\n"
+	out = out + "# before building. Images are listed after the images they are built FROM.\n"
+	out = out + "images:\n"
+	for _, image := range images {
+		if names[image.Base] {
+			out = out + fmt.Sprintf("  # Built FROM %v, which is built by this inventory\n", image.Base)
+		} else {
+			out = out + fmt.Sprintf("  # Built FROM %v\n", image.Base)
+		}
+		out = out + fmt.Sprintf("  - name: %q\n", image.Name)
+		out = out + fmt.Sprintf("    path: %q\n", relativePath(image.Path))
+		if len(image.Tests) > 0 {
+			tests := []string{}
+			for _, test := range image.Tests {
+				tests = append(tests, fmt.Sprintf("%q", relativePath(test)))
+			}
+			out = out + fmt.Sprintf("    test: [%v]\n", strings.Join(tests, ", "))
+		}
+	}
+
+	if len(unassigned) > 0 {
+		out = out + "\n# These tests could not be matched to an image, add them to the right\n"
+		out = out + "# image's test key:\n"
+		for _, test := range unassigned {
+			out = out + fmt.Sprintf("#   %v\n", relativePath(test))
+		}
+	}
+	return out
+}
+
+/*
+initInventory discovers the images under the directory of filename and writes
+them to filename. The inventory is loaded and verified before it replaces
+anything, so init never leaves behind a file the other commands would reject.
+*/
+func initInventory(filename string, namespace string, force bool) (err error) {
+	if _, err = os.Stat(filename); err == nil && !force {
+		return fmt.Errorf("%v already exists, use --force to overwrite it", filename)
+	}
+
+	root := filepath.Dir(filename)
+	images, unassigned, err := discoverInventory(root, namespace)
+	if err != nil {
+		return
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no Dockerfiles with a FROM were found in %v", root)
+	}
+	contents := renderDiscoveredInventory(images, unassigned)
+
+	// Write to a temporary file next to the real one, so relative paths are
+	// verified exactly as they will be used
+	tmp, err := ioutil.TempFile(root, ".inventory.yml")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = GetInventory(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("generated inventory is invalid: %v\n\n%v", err, contents)
+	}
+
+	// Temporary files are only readable by us, inventories are shared
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		return
+	}
+	fmt.Printf("%v", contents)
+	return
+}
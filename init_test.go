@@ -0,0 +1,28 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestProposeName(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "My Project")
+	for _, test := range []struct {
+		dir        string
+		namespace  string
+		name       string
+		repository string
+	}{
+		{"debian/jessie/node/0.12.0", "", "node:0.12.0-jessie", "node"},
+		{"node/0.12.0", "", "node:0.12.0", "node"},
+		{"node", "", "node", "node"},
+		{"node", "example/", "example/node", "node"},
+		{"Web App/v1 beta", "", "web-app:v1-beta", "web-app"},
+		{".", "", "my-project", "my-project"},
+	} {
+		name, repository := proposeName(filepath.FromSlash(test.dir), root, test.namespace)
+		if name != test.name || repository != test.repository {
+			t.Errorf("proposeName(%q, %q) = %q, %q; expected %q, %q", test.dir, test.namespace, name, repository, test.name, test.repository)
+		}
+	}
+}
@@ -1,29 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 /*
-getInventory() simply reads and returns the contents of the inventory.yml file
-located in the process's current working directory.
+getInventory() simply reads and returns the contents of the inventory file
+filename. A relative filename is resolved against the process's current working
+directory.
 */
-func getInventory() (file []byte, err error) {
-	// Begin declaring local variables
-	var cwd, filename string
-	// End declaring local variables
-
-	// The next few lines attempts to get the current working directory of the
-	// process and create an absolute path to the inventory.yml file located
-	// there
-	cwd, err = os.Getwd()
+func getInventory(filename string) (file []byte, err error) {
+	// Get an absolute path to the inventory file
+	filename, err = filepath.Abs(filename)
 	if err != nil {
 		return
 	}
-	filename = filepath.Join(cwd, "inventory.yml")
 
 	// Attempt to read the file into memory
 	file, err = ioutil.ReadFile(filename)
@@ -34,7 +31,8 @@ func getInventory() (file []byte, err error) {
 }
 
 /*
-Inventory is used to unmarshal the inventory.yml file
+Inventory holds the images defined in an inventory.yml file, once all of the
+file's top level settings have been applied to them.
 
 NOTE: This places assumptions on the structure of the inventory.yml file. If
 we want more intuitive error messages moving forward, we may want to add a
@@ -46,36 +44,437 @@ structure of the file.
 type Inventory map[string][]map[string]interface{}
 
 /*
-parseInventory takes in a raw byte array representing an inventory.yml file
-unmarshals it into a go map.
+inventoryFile is used to unmarshal the inventory.yml file. Alongside the images
+it holds the top level settings that are applied while loading the file.
+*/
+type inventoryFile struct {
+	Images   []map[string]interface{} `yaml:"images"`
+	Vars     map[string]string        `yaml:"vars"`
+	Include  stringList               `yaml:"include"`
+	Defaults map[string]interface{}   `yaml:"defaults"`
+	Hosts    []interface{}            `yaml:"hosts"`
+
+	// defaults holds the defaults that apply to each of Images, in order
+	defaults []map[string]interface{}
+	// sources holds every file read while loading, and the includes that
+	// matched them
+	sources inventorySources
+}
+
+/*
+inventorySources lists what an inventory was loaded from: every file that was
+read, including any that failed to load, and every include pattern, so that
+files which would now match an include can be noticed too.
 */
-func parseInventory(file []byte) (obj Inventory, err error) {
-	// Create a new inventory structure that will hold our object
-	obj = Inventory{}
+type inventorySources struct {
+	Files    []string
+	Includes []string
+}
+
+/*
+stringList unmarshals either a single string or an array of strings from yaml,
+mirroring the values accepted by keys like `test` and `alias`.
+*/
+type stringList []string
+
+func (list *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		*list = stringList{str}
+		return nil
+	}
+	var strs []string
+	if err := unmarshal(&strs); err != nil {
+		return err
+	}
+	*list = stringList(strs)
+	return nil
+}
 
-	// Unmarshal and return our new Inventory object
+/*
+parseInventory takes in a raw byte array representing an inventory.yml file
+unmarshals it into a go struct.
+*/
+func parseInventory(file []byte) (obj inventoryFile, err error) {
+	// Unmarshal and return our new inventoryFile object
 	err = yaml.Unmarshal(file, &obj)
 	if err != nil {
-		return nil, err
+		return
 	}
+
+	// The yaml library resolves values like `0.10` to numbers when it
+	// unmarshals into an interface{}, which would turn a build arg of `0.10`
+	// into `0.1`. Unmarshal the keys holding build arg values a second time
+	// into strings so they are kept exactly as written.
+	type rawImage struct {
+		Args   map[string]string   `yaml:"args"`
+		Matrix map[string][]string `yaml:"matrix"`
+	}
+	var raw struct {
+		Images   []rawImage `yaml:"images"`
+		Defaults rawImage   `yaml:"defaults"`
+	}
+	err = yaml.Unmarshal(file, &raw)
+	if err != nil {
+		return
+	}
+	setRaw := func(image map[string]interface{}, r rawImage) {
+		if image == nil {
+			return
+		}
+		if r.Args != nil {
+			image["args"] = r.Args
+		}
+		if r.Matrix != nil {
+			image["matrix"] = r.Matrix
+		}
+	}
+	for i, image := range raw.Images {
+		setRaw(obj.Images[i], image)
+	}
+	setRaw(obj.Defaults, raw.Defaults)
 	return
 }
 
+/*
+getStringArray takes a single image from the inventory.yml file and converts
+the value stored under key (of type interface{}) to an array of strings. This
+allows keys to accept either a single string or an array of strings as a value.
+*/
+func getStringArray(image map[string]interface{}, key string) (strs []string) {
+	switch image[key].(type) {
+	case string:
+		// If the value is a single string, append it to the array and be done
+		strs = append(strs, image[key].(string))
+		break
+	case []interface{}:
+		// If the value is an array, iterate through and add all of the strings
+		// to the array one by one.
+		// Anything that isn't a string is left for verifyInventory to report
+		for _, item := range image[key].([]interface{}) {
+			if str, ok := item.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		break
+	}
+	return
+}
+
+/*
+loadInventory reads the inventory file filename along with every file it
+includes, returning all of their images and variables merged together. Each
+image records the file it was defined in under its `source` key, and included
+files are resolved relative to the directory of the file that includes them.
+seen holds the files currently being loaded so that include cycles can be
+reported instead of recursing forever.
+*/
+func loadInventory(filename string, seen map[string]bool) (merged inventoryFile, err error) {
+	// Begin declaring local variables
+	var file []byte
+	var parsed inventoryFile
+	// End declaring local variables
+
+	filename, err = filepath.Abs(filename)
+	if err != nil {
+		return
+	}
+	if seen[filename] {
+		return merged, fmt.Errorf("%v includes itself", filename)
+	}
+	merged.sources.Files = append(merged.sources.Files, filename)
+	seen[filename] = true
+	defer delete(seen, filename)
+
+	// Load the inventory file from disk
+	file, err = getInventory(filename)
+	if err != nil {
+		return
+	}
+
+	// Convert the inventory file to a go object
+	parsed, err = parseInventory(file)
+	if err != nil {
+		return merged, fmt.Errorf("%v: %v", filename, err)
+	}
+
+	merged.Vars = make(map[string]string)
+	dir := filepath.Dir(filename)
+
+	// Included files come first, so images and variables from the including
+	// file can build on (and override) the ones they include
+	for _, pattern := range parsed.Include {
+		var matches []string
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		merged.sources.Includes = append(merged.sources.Includes, pattern)
+		matches, err = filepath.Glob(pattern)
+		if err != nil {
+			return merged, fmt.Errorf("%v: bad include `%v`: %v", filename, pattern, err)
+		}
+		if len(matches) == 0 {
+			return merged, fmt.Errorf("%v: include `%v` did not match any files", filename, pattern)
+		}
+		for _, match := range matches {
+			var included inventoryFile
+			included, err = loadInventory(match, seen)
+			merged.sources.Files = append(merged.sources.Files, included.sources.Files...)
+			merged.sources.Includes = append(merged.sources.Includes, included.sources.Includes...)
+			if err != nil {
+				return
+			}
+			merged.Images = append(merged.Images, included.Images...)
+			merged.defaults = append(merged.defaults, included.defaults...)
+			merged.Hosts = append(merged.Hosts, included.Hosts...)
+			for key, value := range included.Vars {
+				merged.Vars[key] = value
+			}
+		}
+	}
+
+	for _, image := range parsed.Images {
+		if image == nil {
+			image = make(map[string]interface{})
+		}
+		image["source"] = filename
+		recordPathSource(image, filename)
+		resolveTestPaths(image, dir)
+		merged.Images = append(merged.Images, image)
+		merged.defaults = append(merged.defaults, nil)
+	}
+	for _, entry := range parsed.Hosts {
+		host := hostEntry(entry)
+		host["source"] = filename
+		merged.Hosts = append(merged.Hosts, host)
+	}
+	for key, value := range parsed.Vars {
+		merged.Vars[key] = value
+	}
+
+	// This file's defaults apply to its own images and to those it includes,
+	// but never win over defaults the included files set for themselves
+	if parsed.Defaults != nil {
+		recordPathSource(parsed.Defaults, filename)
+		resolveTestPaths(parsed.Defaults, dir)
+		for i := range merged.defaults {
+			if merged.defaults[i] == nil {
+				merged.defaults[i] = make(map[string]interface{})
+			}
+			inherit(merged.defaults[i], parsed.Defaults)
+		}
+	}
+	return
+}
+
+/*
+internalKeys are the keys dante adds to images and hosts while loading the
+inventory for its own use, which the inventory itself never sets
+*/
+var internalKeys = []string{"source", "path_source", "matrix_group"}
+
+/*
+recordPathSource records filename as the file the path of image, an image or
+a block of defaults, was written in. The path goes wherever image is inherited,
+and its source goes with it, so the path can be resolved against the file that
+wrote it once templates have been resolved.
+*/
+func recordPathSource(image map[string]interface{}, filename string) {
+	if _, ok := image["path"]; ok {
+		image["path_source"] = filename
+	}
+}
+
+/*
+resolvePaths makes the path of every image relative to the directory of the
+inventory file the path was written in, which for an inherited path isn't the
+file the image was defined in. Since paths may be templates, this happens once
+templates have been resolved.
+*/
+func resolvePaths(images []map[string]interface{}) {
+	for _, image := range images {
+		source, ok := image["path_source"].(string)
+		delete(image, "path_source")
+		if !ok {
+			continue
+		}
+		if path, ok := image["path"].(string); ok {
+			image["path"] = resolvePath(filepath.Dir(source), path)
+		}
+	}
+}
+
+/*
+resolveTestPaths makes the tests of image relative to dir. Unlike paths, tests
+are never templates so they are resolved as soon as their file is loaded, which
+keeps them pointing at the right place when they are inherited by images in
+other files.
+*/
+func resolveTestPaths(image map[string]interface{}, dir string) {
+	if _, ok := image["test"]; !ok {
+		return
+	}
+	resolved := []interface{}{}
+	for _, test := range getTestEntries(image) {
+		if path, ok := test.(string); ok {
+			resolved = append(resolved, resolvePath(dir, path))
+		} else if fields, ok := yamlMap(test); ok {
+			resolved = append(resolved, resolveTestEntryPaths(fields, dir))
+		} else {
+			resolved = append(resolved, test)
+		}
+	}
+	image["test"] = resolved
+}
+
+/*
+resolvePath returns path relative to dir, unless it is already absolute
+*/
+func resolvePath(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
 /*
 verifyInventory ensures the structure and contents of an inventory.yml file are
-correct before the application attempts to process it.
+correct before the application attempts to process it. Every problem found in
+the inventory (and the files it includes) is reported at once.
 */
 func verifyInventory(inventory Inventory) (err error) {
-	// Currently we do absolutely no verification, we simply allow the application
-	// to fail. This function will be useful moving forward when the need for
-	// more intuitive error messages arises.
+	problems := []string{}
+	report := func(image map[string]interface{}, format string, args ...interface{}) {
+		problem := fmt.Sprintf(format, args...)
+		if source, ok := image["source"].(string); ok {
+			problem = source + ": " + problem
+		}
+		problems = append(problems, problem)
+	}
+
+	names := make(map[string]string)
+	for i, image := range inventory["images"] {
+		name, ok := image["name"].(string)
+		if !ok || name == "" {
+			report(image, "image #%v is missing a name", i)
+			name = fmt.Sprintf("#%v", i)
+		} else if previous, ok := names[name]; ok {
+			report(image, "image `%v` is already defined in %v", name, previous)
+		} else {
+			names[name], _ = image["source"].(string)
+		}
+
+		path, ok := image["path"].(string)
+		if !ok {
+			report(image, "image `%v` is missing a path", name)
+		} else if containsDockerfile(path) != nil {
+			report(image, "image `%v` has no Dockerfile in `%v`", name, path)
+		}
+
+		for _, test := range getTestEntries(image) {
+			if problem := verifyTestEntry(test); problem != "" {
+				report(image, "image `%v` has an invalid test: %v", name, problem)
+			}
+		}
+
+		if problem := verifyResources(image); problem != "" {
+			report(image, "image `%v` has a %v", name, problem)
+		}
+
+		if problem := verifySizeBudget(image); problem != "" {
+			report(image, "image `%v` has a %v", name, problem)
+		}
+
+		if problem := verifyLintOpts(image); problem != "" {
+			report(image, "image `%v` has an invalid lint: %v", name, problem)
+		}
+
+		for _, key := range []string{"alias", "registries", "push_to"} {
+			if !isStringArray(image[key]) {
+				report(image, "image `%v` has a %v that isn't a string or array of strings", name, key)
+			}
+		}
+
+		for _, key := range []string{"retries", stepBuild + "_retries", stepTest + "_retries", stepPush + "_retries"} {
+			if _, ok := image[key]; !ok {
+				continue
+			}
+			if retries, ok := image[key].(int); !ok || retries < 0 {
+				report(image, "image `%v` has %v that isn't a non-negative number", name, key)
+			}
+		}
+
+		if _, ok := image["timeout"]; ok {
+			timeout, _ := image["timeout"].(string)
+			if _, err := time.ParseDuration(timeout); err != nil {
+				report(image, "image `%v` has a timeout that isn't a duration like `10m`", name)
+			}
+		}
+
+		for _, test := range getTestArray(image) {
+			if containsDockerfile(test) != nil {
+				report(image, "image `%v` has no Dockerfile in test `%v`", name, test)
+			}
+		}
+	}
+
+	hosts := make(map[string]bool)
+	for i, host := range inventory["hosts"] {
+		if problem := verifyHost(host); problem != "" {
+			report(host, "host #%v %v", i, problem)
+		} else if hosts[host["name"].(string)] {
+			report(host, "host `%v` is already defined", host["name"])
+		} else {
+			hosts[host["name"].(string)] = true
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid inventory:\n\n  %v", strings.Join(problems, "\n  "))
+	}
 	return nil
 }
 
 /*
-containsDockerfile ensures that a dockerfile exists in a directory. This is
-currently not used, but will serve a purpose in the verifyInventory function
-moving forward.
+yamlMap returns value as a map if it is one, such as the test entry
+`{kind: scan, scanner: trivy}`. YAML decodes nested maps with interface{} keys,
+so they are converted to string keys here.
+*/
+func yamlMap(value interface{}) (fields map[string]interface{}, ok bool) {
+	switch value.(type) {
+	case map[string]interface{}:
+		return value.(map[string]interface{}), true
+	case map[interface{}]interface{}:
+		fields = make(map[string]interface{})
+		for key, item := range value.(map[interface{}]interface{}) {
+			fields[fmt.Sprint(key)] = item
+		}
+		return fields, true
+	}
+	return nil, false
+}
+
+/*
+isStringArray returns true if value is missing, a string or an array of
+strings, which is what getStringArray expects to find.
+*/
+func isStringArray(value interface{}) bool {
+	switch value.(type) {
+	case nil, string:
+		return true
+	case []interface{}:
+		for _, item := range value.([]interface{}) {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+/*
+containsDockerfile ensures that a dockerfile exists in a directory.
 */
 func containsDockerfile(dockerdir string) (err error) {
 	var dockerDir, dockerfile string
@@ -98,30 +497,65 @@ func containsDockerfile(dockerdir string) (err error) {
 
 /*
 GetInventory is the method you should be calling when interacting with the
-contents of this file. It loads in an inventory.yml file, converts it to a go
-object, verifies its structure, and returns the object.
+contents of this file. It loads in the inventory file filename and everything
+it includes, converts it to a go object, verifies its structure, and returns
+the object.
+*/
+func GetInventory(filename string) (inventory Inventory, err error) {
+	inventory, _, err = readInventory(filename)
+	return
+}
+
+/*
+readInventory loads the inventory file filename like GetInventory, and also
+returns the sources it was loaded from. The sources are returned even when
+loading fails, so a broken file can be watched until it is fixed.
 */
-func GetInventory() (inventory Inventory, err error) {
+func readInventory(filename string) (inventory Inventory, sources inventorySources, err error) {
 	// Begin declaring local variables
-	var file []byte
+	var parsed inventoryFile
 	// End declaring local variables
 
-	// Load the inventory file from disk
-	file, err = getInventory()
+	// Load the inventory file, and everything it includes, from disk
+	parsed, err = loadInventory(filename, make(map[string]bool))
+	sources = parsed.sources
 	if err != nil {
-		return nil, err
+		return nil, sources, err
 	}
 
-	// Convert the inventory file to a go object
-	inventory, err = parseInventory(file)
+	// Fill in settings images inherit from their parents and defaults
+	err = applyInheritance(parsed.Images, parsed.defaults)
 	if err != nil {
-		return nil, err
+		return nil, sources, err
+	}
+
+	// Expand every matrix into the images it describes
+	parsed.Images, err = expandMatrices(parsed.Images)
+	if err != nil {
+		return nil, sources, err
+	}
+
+	// Expand any templates so the rest of the application sees literal values
+	err = resolveTemplates(parsed.Images, parsed.Vars)
+	if err != nil {
+		return nil, sources, err
+	}
+
+	// Paths are written relative to the file they appear in
+	resolvePaths(parsed.Images)
+	inventory = Inventory{"images": parsed.Images}
+	if len(parsed.Hosts) > 0 {
+		hosts := []map[string]interface{}{}
+		for _, host := range parsed.Hosts {
+			hosts = append(hosts, host.(map[string]interface{}))
+		}
+		inventory["hosts"] = hosts
 	}
 
 	// Verify the structure of the inventory object
 	err = verifyInventory(inventory)
 	if err != nil {
-		return nil, err
+		return nil, sources, err
 	}
 	return
 }
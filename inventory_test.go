@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetInventoryInheritedPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, context := range []string{"shared/app", "shared/tool-1", "local"} {
+		if err := os.MkdirAll(filepath.Join(dir, context), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, context), "Dockerfile", "FROM alpine\n")
+	}
+	writeFile(t, filepath.Join(dir, "shared"), "images.yml", `
+defaults:
+  path: "tool-{{.Vars.version}}"
+images:
+  - name: app
+    path: app
+  - name: tool
+`)
+	filename := writeFile(t, dir, "inventory.yml", `
+include: shared/images.yml
+vars:
+  version: "1"
+images:
+  - name: child
+    extends: app
+  - name: own
+    extends: app
+    path: local
+`)
+
+	inventory, err := GetInventory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"app":   filepath.Join(dir, "shared", "app"),
+		"tool":  filepath.Join(dir, "shared", "tool-1"),
+		"child": filepath.Join(dir, "shared", "app"),
+		"own":   filepath.Join(dir, "local"),
+	}
+	for _, image := range inventory["images"] {
+		name := image["name"].(string)
+		if image["path"] != expected[name] {
+			t.Errorf("`%v` has path %v, expected %v", name, image["path"], expected[name])
+		}
+		if _, ok := image["path_source"]; ok {
+			t.Errorf("`%v` kept the file its path came from", name)
+		}
+	}
+}
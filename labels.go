@@ -0,0 +1,123 @@
+/*
+labels.go contains the labels dante applies to the images it builds, which
+record how each image was made and let dante find those images again later
+*/
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// labelRole records why dante built an image, either roleImage or roleTest
+	labelRole = "io.dante.role"
+	// labelImage records the inventory image an image was built for
+	labelImage = "io.dante.image"
+	// labelVersion records the version of dante that built an image
+	labelVersion = "io.dante.version"
+	// labelMatrix records the matrix cell an image was built for
+	labelMatrix = "io.dante.matrix"
+	// labelTest records the path of the test a test image was built from
+	labelTest = "io.dante.test"
+	// labelTestNumber records which of its image's tests a test image is
+	labelTestNumber = "io.dante.test.number"
+	// labelTestStatus records the result of the test a test image was built
+	// for, testPassed or testFlaky
+	labelTestStatus = "io.dante.test.status"
+
+	// The standard OCI annotations, see
+	// https://github.com/opencontainers/image-spec/blob/master/annotations.md
+	labelCreated  = "org.opencontainers.image.created"
+	labelRevision = "org.opencontainers.image.revision"
+	labelSource   = "org.opencontainers.image.source"
+
+	// roleImage marks an image built from an inventory entry's path
+	roleImage = "image"
+	// roleTest marks an image built from one of an inventory entry's tests
+	roleTest = "test"
+)
+
+/*
+sourceLabels holds the labels describing the source tree of each directory
+inventory files were loaded from. They are the same for every image from that
+directory, so they are only looked up once.
+*/
+var sourceLabels = make(map[string]map[string]string)
+var sourceLabelsMutex sync.Mutex
+
+/*
+getSourceLabels returns the labels describing the git checkout dir is in
+*/
+func getSourceLabels(dir string) map[string]string {
+	sourceLabelsMutex.Lock()
+	defer sourceLabelsMutex.Unlock()
+	if labels, ok := sourceLabels[dir]; ok {
+		return labels
+	}
+
+	// Outside of a git repository there is nothing to record
+	labels := make(map[string]string)
+	if revision := gitOutput(dir, "rev-parse", "HEAD"); revision != "" {
+		labels[labelRevision] = revision
+	}
+	if source := gitOutput(dir, "config", "--get", "remote.origin.url"); source != "" {
+		labels[labelSource] = source
+	}
+	if committed, err := strconv.ParseInt(gitOutput(dir, "log", "-1", "--format=%ct"), 10, 64); err == nil {
+		labels[labelCreated] = time.Unix(committed, 0).UTC().Format(time.RFC3339)
+	}
+	sourceLabels[dir] = labels
+	return labels
+}
+
+/*
+provenanceLabels returns the labels shared by every image dante builds: where
+it was built from, when, and by which version of dante. The time of the build
+itself would give every build a new image ID, so the creation time is the one
+in SOURCE_DATE_EPOCH, or else the time of the commit being built, which keeps
+rebuilds of the same source reproducible.
+*/
+func provenanceLabels(image ImageDefinition) map[string]string {
+	labels := map[string]string{
+		labelImage:   image["name"].(string),
+		labelVersion: version,
+	}
+	for key, value := range getSourceLabels(sourceDir(image)) {
+		labels[key] = value
+	}
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		labels[labelCreated] = time.Unix(epoch, 0).UTC().Format(time.RFC3339)
+	}
+	if cell := getMatrixCell(image); cell != nil {
+		labels[labelMatrix] = formatMatrixCell(cell)
+	}
+	return labels
+}
+
+/*
+imageLabels returns the labels for an image built directly from the inventory
+entry image
+*/
+func imageLabels(image ImageDefinition) map[string]string {
+	labels := provenanceLabels(image)
+	labels[labelRole] = roleImage
+	return labels
+}
+
+/*
+testLabels returns the labels for an image built from the test at index testNum
+of the inventory entry image. Docker only produces an image once every
+instruction in the Dockerfile has succeeded, so a test image always records a
+test that passed, with status saying whether it took retries to get there.
+*/
+func testLabels(image ImageDefinition, testNum int, test string, status string) map[string]string {
+	labels := provenanceLabels(image)
+	labels[labelRole] = roleTest
+	labels[labelTest] = test
+	labels[labelTestNumber] = strconv.Itoa(testNum + 1)
+	labels[labelTestStatus] = status
+	return labels
+}
@@ -0,0 +1,239 @@
+/*
+lint.go contains the Dockerfile linter that runs before an image is built, so
+common mistakes are caught without waiting on a build
+*/
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// ruleUnpinnedBase flags FROM lines without a tag or digest
+	ruleUnpinnedBase = "unpinned-base"
+	// ruleLatestTag flags FROM lines using the `latest` tag
+	ruleLatestTag = "latest-tag"
+	// ruleAptRecommends flags apt-get installs that pull in recommended packages
+	ruleAptRecommends = "apt-no-install-recommends"
+	// ruleAddURL flags ADD instructions that download from a URL
+	ruleAddURL = "add-url"
+	// ruleMissingUser flags images that run as root
+	ruleMissingUser = "missing-user"
+)
+
+/*
+lintRules lists every rule the linter checks, which are the ids that can be
+given to `ignore`
+*/
+var lintRules = []string{ruleUnpinnedBase, ruleLatestTag, ruleAptRecommends, ruleAddURL, ruleMissingUser}
+
+/*
+LintProblem is a single rule broken by a Dockerfile
+*/
+type LintProblem struct {
+	Line    int
+	Rule    string
+	Message string
+}
+
+/*
+LintOpts is how an image from the inventory has configured linting with its
+`lint` key
+*/
+type LintOpts struct {
+	Enabled bool
+	// Block skips building images that have lint problems
+	Block bool
+	// Ignore lists the rules that aren't checked
+	Ignore []string
+}
+
+/*
+getLintOpts reads the lint key of image, which is either a boolean or a map
+like `{block: true, ignore: [missing-user]}`. A map enables linting unless it
+sets `enabled: false`.
+*/
+func getLintOpts(image map[string]interface{}) (opts LintOpts) {
+	if enabled, ok := image["lint"].(bool); ok {
+		opts.Enabled = enabled
+		return
+	}
+	fields, ok := yamlMap(image["lint"])
+	if !ok {
+		return
+	}
+	opts.Enabled = true
+	if enabled, ok := fields["enabled"].(bool); ok {
+		opts.Enabled = enabled
+	}
+	opts.Block, _ = fields["block"].(bool)
+	opts.Ignore = getStringArray(fields, "ignore")
+	return
+}
+
+/*
+verifyLintOpts returns a description of what is wrong with the lint key of
+image, or the empty string if nothing is
+*/
+func verifyLintOpts(image map[string]interface{}) string {
+	switch image["lint"].(type) {
+	case nil, bool:
+		return ""
+	}
+	fields, ok := yamlMap(image["lint"])
+	if !ok {
+		return "it must be true, false or a map"
+	}
+	for _, key := range []string{"enabled", "block"} {
+		if _, ok := fields[key]; !ok {
+			continue
+		}
+		if _, ok := fields[key].(bool); !ok {
+			return fmt.Sprintf("`%v` isn't true or false", key)
+		}
+	}
+	if !isStringArray(fields["ignore"]) {
+		return "`ignore` isn't a string or array of strings"
+	}
+	known := make(map[string]bool)
+	for _, rule := range lintRules {
+		known[rule] = true
+	}
+	for _, rule := range getStringArray(fields, "ignore") {
+		if !known[rule] {
+			return fmt.Sprintf("`ignore` lists the unknown rule `%v`", rule)
+		}
+	}
+	return ""
+}
+
+/*
+aptInstallPattern matches an `apt-get install` command, allowing for options
+between the two such as `apt-get -y install`
+*/
+var aptInstallPattern = regexp.MustCompile(`\bapt-get\s+(-\S+\s+)*install\b`)
+
+/*
+lintDockerfile checks the instructions of a Dockerfile against every lint
+rule, using args to fill in the build args referenced by its FROM lines
+*/
+func lintDockerfile(instructions []Instruction, args map[string]string) (problems []LintProblem) {
+	report := func(instruction Instruction, rule string, format string, a ...interface{}) {
+		problems = append(problems, LintProblem{
+			Line:    instruction.Line,
+			Rule:    rule,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+
+	stages := make(map[string]bool)
+	var user *Instruction
+	var lastFrom Instruction
+	for _, instruction := range instructions {
+		switch instruction.Command {
+		case "FROM":
+			fields := fromFields(instruction.Args)
+			if len(fields) == 0 {
+				continue
+			}
+			lastFrom = instruction
+			// Each stage starts again as root
+			user = nil
+
+			// Stages built earlier in the Dockerfile, scratch and digests are
+			// all already pinned
+			base := expandBuildArgs(fields[0], args)
+			_, _, tag := splitReference(base)
+			pinned := stages[strings.ToLower(base)] || base == "scratch" || strings.Contains(base, "@")
+			if !pinned && tag == "" {
+				report(instruction, ruleUnpinnedBase, "`%v` has no tag, so it will change whenever `latest` does", base)
+			} else if !pinned && tag == "latest" {
+				report(instruction, ruleLatestTag, "`%v` uses the `latest` tag, which changes without warning", base)
+			}
+
+			if len(fields) == 3 && strings.ToUpper(fields[1]) == "AS" {
+				stages[strings.ToLower(fields[2])] = true
+			}
+		case "RUN":
+			for _, command := range strings.FieldsFunc(instruction.Args, func(r rune) bool {
+				return r == ';' || r == '&' || r == '|'
+			}) {
+				if aptInstallPattern.MatchString(command) && !strings.Contains(command, "--no-install-recommends") {
+					report(instruction, ruleAptRecommends, "`apt-get install` without `--no-install-recommends` installs packages nothing asked for")
+				}
+			}
+		case "ADD":
+			for _, field := range strings.Fields(instruction.Args) {
+				if strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://") {
+					report(instruction, ruleAddURL, "`ADD %v` downloads without verifying what it got, prefer `RUN curl` with a checksum", field)
+				}
+			}
+		case "USER":
+			current := instruction
+			user = &current
+		}
+	}
+
+	// Only the final stage decides who the image runs as
+	if lastFrom.Command != "" {
+		if user == nil {
+			report(lastFrom, ruleMissingUser, "the image runs as root since its final stage never sets a `USER`")
+		} else if name := strings.SplitN(strings.TrimSpace(user.Args), ":", 2)[0]; name == "root" || name == "0" {
+			report(*user, ruleMissingUser, "the image explicitly runs as root")
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	return
+}
+
+/*
+testLint lints the Dockerfile for image if it has linting enabled, and returns
+an error if any rule it doesn't ignore is broken. Problems are reported as a
+table in the test output.
+*/
+func testLint(image ImageDefinition) (output string, err error) {
+	opts := getLintOpts(image)
+	if !opts.Enabled {
+		return
+	}
+	output = fmt.Sprintf("## Lint\n\n")
+
+	path, _ := image["path"].(string)
+	instructions, err := parseDockerfile(path)
+	if err != nil {
+		output = output + fmt.Sprintf("**Failed** Could not read Dockerfile in `%v`: `%v`\n\n", path, err)
+		return
+	}
+
+	ignored := make(map[string]bool)
+	for _, rule := range opts.Ignore {
+		ignored[rule] = true
+	}
+	problems := []LintProblem{}
+	for _, problem := range lintDockerfile(instructions, fromArgs(instructions, image)) {
+		if !ignored[problem.Rule] {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) == 0 {
+		output = output + fmt.Sprintf("No problems found\n\n")
+		return
+	}
+
+	output = output + fmt.Sprintf("| Line | Rule | Problem |\n")
+	output = output + fmt.Sprintf("|------|------|---------|\n")
+	for _, problem := range problems {
+		output = output + fmt.Sprintf("| %v | %v | %v |\n", problem.Line, problem.Rule, problem.Message)
+	}
+	output = output + fmt.Sprintf("\n")
+
+	err = fmt.Errorf("%v lint problems in %v", len(problems), path)
+	output = output + fmt.Sprintf("**Failed** with error: `%v`\n\n", err)
+	return
+}
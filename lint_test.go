@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/*
+brokenRules returns the rules broken by the Dockerfile contents, with the line
+each was broken on, like `3:add-url`
+*/
+func brokenRules(t *testing.T, contents string, args map[string]string) []string {
+	dir := t.TempDir()
+	writeFile(t, dir, "Dockerfile", contents)
+	instructions, err := parseDockerfile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []string{}
+	for _, problem := range lintDockerfile(instructions, args) {
+		rules = append(rules, fmt.Sprintf("%v:%v", problem.Line, problem.Rule))
+	}
+	return rules
+}
+
+func TestLintDockerfile(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		dockerfile string
+		args       map[string]string
+		expected   []string
+	}{
+		{"clean", "FROM alpine:3.18\nUSER app\n", nil, []string{}},
+		{"unpinned", "FROM alpine\nUSER app\n", nil, []string{"1:unpinned-base"}},
+		{"latest", "FROM alpine:latest\nUSER app\n", nil, []string{"1:latest-tag"}},
+		{"digest", "FROM alpine@sha256:abc\nUSER app\n", nil, []string{}},
+		{"scratch", "FROM scratch\nUSER app\n", nil, []string{}},
+		{"stage", "FROM golang:1.21 AS build\nFROM build\nUSER app\n", nil, []string{}},
+		{"arg", "ARG VERSION\nFROM alpine:$VERSION\nUSER app\n", map[string]string{"VERSION": "3.18"}, []string{}},
+		{"apt", "FROM debian:12\nRUN apt-get update && apt-get -y install curl\nUSER app\n", nil, []string{"2:apt-no-install-recommends"}},
+		{"apt pinned", "FROM debian:12\nRUN apt-get install --no-install-recommends -y curl\nUSER app\n", nil, []string{}},
+		{"add url", "FROM alpine:3.18\nADD https://example.com/x.tar /\nUSER app\n", nil, []string{"2:add-url"}},
+		{"root", "FROM alpine:3.18\n", nil, []string{"1:missing-user"}},
+		{"explicit root", "FROM alpine:3.18\nUSER root:root\n", nil, []string{"2:missing-user"}},
+		{"earlier stage user", "FROM alpine:3.18 AS build\nUSER app\nFROM alpine:3.18\n", nil, []string{"3:missing-user"}},
+	} {
+		if rules := brokenRules(t, test.dockerfile, test.args); !reflect.DeepEqual(rules, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, rules)
+		}
+	}
+}
+
+func TestTestLint(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "app")
+	writeFile(t, path, "Dockerfile", "FROM alpine\n")
+
+	for _, test := range []struct {
+		lint   interface{}
+		failed bool
+	}{
+		{nil, false},
+		{false, false},
+		{true, true},
+		{map[interface{}]interface{}{"ignore": []interface{}{ruleUnpinnedBase, ruleMissingUser}}, false},
+		{map[interface{}]interface{}{"ignore": ruleUnpinnedBase}, true},
+		{map[interface{}]interface{}{"enabled": false}, false},
+	} {
+		image := ImageDefinition{"name": "app", "path": path}
+		if test.lint != nil {
+			image["lint"] = test.lint
+		}
+		if _, err := testLint(image); (err != nil) != test.failed {
+			t.Errorf("lint %v: got %v, expected failure %v", test.lint, err, test.failed)
+		}
+	}
+}
+
+func TestVerifyLintOpts(t *testing.T) {
+	for _, test := range []struct {
+		lint     interface{}
+		expected string
+	}{
+		{nil, ""},
+		{true, ""},
+		{map[interface{}]interface{}{"block": true, "ignore": ruleAddURL}, ""},
+		{"yes", "it must be true, false or a map"},
+		{map[interface{}]interface{}{"block": "yes"}, "`block` isn't true or false"},
+		{map[interface{}]interface{}{"ignore": 42}, "`ignore` isn't a string or array of strings"},
+		{map[interface{}]interface{}{"ignore": "no-such-rule"}, "`ignore` lists the unknown rule `no-such-rule`"},
+	} {
+		if problem := verifyLintOpts(map[string]interface{}{"lint": test.lint}); problem != test.expected {
+			t.Errorf("verifyLintOpts(%v) = %q, expected %q", test.lint, problem, test.expected)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+matrix.go contains the logic for expanding a single image from inventory.yml
+into one image for every combination of the values in its `matrix` key
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+expandMatrices replaces every image with a `matrix` key with one image per cell
+of its matrix. Each cell's values are added to the image's build args, and the
+cell itself is left in the `matrix` key so templates can refer to it as
+`{{.Matrix.KEY}}`. The unexpanded name is kept in `matrix_group` so results can
+be reported together.
+*/
+func expandMatrices(images []map[string]interface{}) (expanded []map[string]interface{}, err error) {
+	for _, image := range images {
+		matrix, ok := image["matrix"].(map[string][]string)
+		if !ok || len(matrix) == 0 {
+			expanded = append(expanded, image)
+			continue
+		}
+
+		for _, cell := range matrixCells(matrix) {
+			// Give every cell its own copy of the image, and of the build args
+			// since those differ between cells
+			cellImage := make(map[string]interface{})
+			for key, value := range image {
+				cellImage[key] = value
+			}
+			args := make(map[string]string)
+			for key, value := range getBuildArgs(image) {
+				args[key] = value
+			}
+			for key, value := range cell {
+				args[key] = value
+			}
+			cellImage["args"] = args
+			cellImage["matrix"] = cell
+			cellImage["matrix_group"] = image["name"]
+			expanded = append(expanded, cellImage)
+		}
+	}
+	return
+}
+
+/*
+matrixCells returns every combination of the values in matrix. Keys are walked
+in sorted order so that the cells always come out in the same order.
+*/
+func matrixCells(matrix map[string][]string) []map[string]string {
+	keys := []string{}
+	for key := range matrix {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cells := []map[string]string{{}}
+	for _, key := range keys {
+		next := []map[string]string{}
+		for _, cell := range cells {
+			for _, value := range matrix[key] {
+				newCell := map[string]string{key: value}
+				for k, v := range cell {
+					newCell[k] = v
+				}
+				next = append(next, newCell)
+			}
+		}
+		cells = next
+	}
+	return cells
+}
+
+/*
+getBuildArgs returns the build args for an image from its `args` key
+*/
+func getBuildArgs(image map[string]interface{}) map[string]string {
+	args, _ := image["args"].(map[string]string)
+	return args
+}
+
+/*
+getMatrixCell returns the matrix cell an expanded image was built for, or nil
+if the image didn't come from a matrix
+*/
+func getMatrixCell(image map[string]interface{}) map[string]string {
+	cell, _ := image["matrix"].(map[string]string)
+	return cell
+}
+
+/*
+formatMatrixCell renders a cell as `KEY=value` pairs in sorted key order
+*/
+func formatMatrixCell(cell map[string]string) string {
+	pairs := []string{}
+	for key, value := range cell {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+/*
+reportMatrices prints the results of every image that came from a matrix,
+grouped under the image they were expanded from. results maps each image's
+index in the inventory to the job that built it.
+*/
+func reportMatrices(inventory Inventory, results map[int]Job) {
+	groups := []string{}
+	cells := make(map[string][]int)
+	for i, image := range inventory["images"] {
+		group, ok := image["matrix_group"].(string)
+		if !ok {
+			continue
+		}
+		if cells[group] == nil {
+			groups = append(groups, group)
+		}
+		cells[group] = append(cells[group], i)
+	}
+
+	if len(groups) == 0 {
+		return
+	}
+
+	fmt.Printf("# Matrix Results\n\n")
+	for _, group := range groups {
+		fmt.Printf("## `%v`\n\n| Cell | Image | Result |\n|---|---|---|\n", group)
+		for _, i := range cells[group] {
+			image := inventory["images"][i]
+			result := "passed"
+			if !results[i].Success {
+				result = "**failed**"
+			}
+			fmt.Printf("| `%v` | `%v` | %v |\n", formatMatrixCell(getMatrixCell(image)), image["name"], result)
+		}
+		fmt.Printf("\n")
+	}
+}
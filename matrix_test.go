@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandMatrices(t *testing.T) {
+	images := []map[string]interface{}{
+		{"name": "plain"},
+		{
+			"name":   "node:{{.Matrix.NODE}}-{{.Matrix.DISTRO}}",
+			"args":   map[string]string{"NODE": "0", "EXTRA": "1"},
+			"matrix": map[string][]string{"NODE": {"0.10", "4"}, "DISTRO": {"jessie", "alpine"}},
+		},
+	}
+	expanded, err := expandMatrices(images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expanded) != 5 || expanded[0]["name"] != "plain" {
+		t.Fatalf("expected `plain` followed by four cells, got %v", expanded)
+	}
+
+	// Cells come out in sorted key order, DISTRO before NODE
+	expected := []map[string]string{
+		{"DISTRO": "jessie", "NODE": "0.10"},
+		{"DISTRO": "jessie", "NODE": "4"},
+		{"DISTRO": "alpine", "NODE": "0.10"},
+		{"DISTRO": "alpine", "NODE": "4"},
+	}
+	for i, cell := range expected {
+		image := expanded[i+1]
+		if !reflect.DeepEqual(getMatrixCell(image), cell) {
+			t.Errorf("cell #%v is %v, expected %v", i, getMatrixCell(image), cell)
+		}
+		args := map[string]string{"EXTRA": "1", "DISTRO": cell["DISTRO"], "NODE": cell["NODE"]}
+		if !reflect.DeepEqual(getBuildArgs(image), args) {
+			t.Errorf("cell #%v has args %v, expected %v", i, getBuildArgs(image), args)
+		}
+		if image["matrix_group"] != images[1]["name"] {
+			t.Errorf("cell #%v is in group %v", i, image["matrix_group"])
+		}
+	}
+
+	// Every cell has its own args, and the image's own are left alone
+	getBuildArgs(expanded[1])["EXTRA"] = "changed"
+	if getBuildArgs(expanded[2])["EXTRA"] != "1" || getBuildArgs(images[1])["NODE"] != "0" {
+		t.Error("cells share their build args")
+	}
+}
+
+func TestGetInventoryMatrix(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "node"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "node"), "Dockerfile", "ARG NODE\nFROM node:$NODE\n")
+	filename := writeFile(t, dir, "inventory.yml", `
+images:
+  - name: "node:{{.Matrix.NODE}}"
+    path: node
+    matrix:
+      NODE: [0.10, 4.0]
+`)
+	inventory, err := GetInventory(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, image := range inventory["images"] {
+		names = append(names, image["name"].(string))
+		if image["matrix_group"] != "node:<NODE>" {
+			t.Errorf("`%v` is in group %v, expected `node:<NODE>`", image["name"], image["matrix_group"])
+		}
+	}
+	// Values are kept exactly as written, not read as numbers
+	if expected := []string{"node:0.10", "node:4.0"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected images %v, got %v", expected, names)
+	}
+}
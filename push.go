@@ -1,101 +1,322 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 )
 
-func runPushes(inventory Inventory, opts TestOpts) (errs int) {
+/*
+Push policies decide how an image with several registries is judged when only
+some of its destinations accepted the push.
+*/
+const (
+	// pushPolicyAll fails the image unless every destination succeeded
+	pushPolicyAll = "all"
+	// pushPolicyAny passes the image if at least one destination succeeded
+	pushPolicyAny = "any"
+)
+
+/*
+runPushes pushes every reference of every image in inventory to each of its
+destinations, and returns the number of images that failed their push policy
+along with how many jobs finished with each status. With opts.FailFast the
+first failed push cancels everything still running or queued.
+*/
+func runPushes(inventory Inventory, opts TestOpts) (errs int, statuses map[string]int) {
 
 	input := make(chan Job)
 	output := make(chan Job)
 
-	// Get job count
+	// Get job count, every reference of an image is pushed once to each of
+	// its destinations
 	jobs := 0
 	for _, image := range inventory["images"] {
-		jobs++
-		aliases := getAliasArray(image)
-		for range aliases {
-			jobs++
-		}
+		jobs += len(getPushReferences(image)) * len(getPushDestinations(image))
 	}
 
-	done := make(chan bool, jobs)
+	done := make(chan Job, jobs)
+
+	// Images are pushed from the host test built them on
+	hosts := getHosts(inventory)
+	assigned := assignHosts(inventory, hosts)
+	reportHosts(inventory, hosts, assigned)
+	scheds := newHostSchedulers(hosts, map[string]int{
+		stepPush: opts.MaxPushes,
+	})
+	reportSchedulers(hosts, scheds)
 
-	for i := 0; i < opts.Threads; i++ {
-		go pushWorker(input, output)
+	for i := 0; i < workerCount(opts, jobs); i++ {
+		go pushWorker(input, output, scheds)
 	}
 
-	go reporter(output, done)
+	// On a terminal every push is followed live, and the output of each is
+	// printed once they are all over rather than as it finishes
+	var ui *tui
+	if useTUI() {
+		ui = newTUI()
+	}
+
+	go reporter(output, done, ui != nil)
 
+	queue := []Job{}
 	for i, image := range inventory["images"] {
-		input <- Job{
-			Image:   image,
-			Retries: opts.Retries,
-			Id:      i,
-		}
-		aliases := getAliasArray(image)
-		for _, alias := range aliases {
-			aliasImage := make(ImageDefinition)
-			aliasImage["name"] = alias
-			input <- Job{
-				Image:   aliasImage,
-				Retries: opts.Retries,
-				Id:      i,
+		for _, registry := range getPushDestinations(image) {
+			signed := make(map[string]bool)
+			for _, ref := range getPushReferences(image) {
+				// Each reference is pushed with the settings of its image
+				refImage := make(ImageDefinition)
+				for key, value := range image {
+					refImage[key] = value
+				}
+				refImage["name"] = ref
+				job := Job{
+					Image:    refImage,
+					Retries:  opts.Retries,
+					Id:       i,
+					Registry: registry,
+					Host:     assigned[image["name"].(string)],
+				}
+				// Aliases share the image's digest, but signatures and
+				// attestations are stored in each repository, so they are
+				// attached by the first reference to each repository of a
+				// destination. Signing every alias would have their jobs
+				// rewrite the same signature manifest at once.
+				repository := pushRepository(ref, registry)
+				if !signed[repository] {
+					signed[repository] = true
+					job.Attest = opts.Attest
+					job.SignKey = opts.SignKey
+				}
+				if ui != nil {
+					name := ref
+					if registry != "" {
+						name = ref + " to " + registry
+					}
+					job.Log, job.State = ui.add(name)
+				}
+				queue = append(queue, job)
 			}
 		}
 	}
+	if ui != nil {
+		ui.start()
+	}
 
-	errs = 0
+	// Queue the jobs in the background so failures are seen as they happen,
+	// not once every job has been handed to a worker
+	go func() {
+		for _, job := range queue {
+			input <- job
+		}
+	}()
+
+	// A destination has succeeded once every reference pushed to it has
+	// succeeded, so track the first failure for each image's destinations
+	failed := make(map[int]map[string]string)
+	statuses = make(map[string]int)
+	finished := []Job{}
 	for i := 0; i < jobs; i++ {
-		if <-done == false {
-			errs++
+		job := <-done
+		job.setState(job.Status)
+		finished = append(finished, job)
+		statuses[job.Status]++
+		if !job.Success && opts.FailFast {
+			cancelJobs()
+		}
+		if failed[job.Id] == nil {
+			failed[job.Id] = make(map[string]string)
+		}
+		if !job.Success && failed[job.Id][job.Registry] == "" {
+			failed[job.Id][job.Registry] = job.Status
+		}
+	}
+	// Every job is done, so the workers and reporter can stop
+	close(input)
+	close(output)
+	if ui != nil {
+		ui.stop()
+		for _, job := range finished {
+			fmt.Printf("%v", job.Output)
+		}
+	}
+
+	fmt.Printf("# Push Summary\n\n| Image | Destination | Result |\n|---|---|---|\n")
+	errs = 0
+	for i, image := range inventory["images"] {
+		policy := getPushPolicy(image, opts)
+		succeeded := 0
+		for _, registry := range getPushDestinations(image) {
+			destination := registry
+			if destination == "" {
+				destination = "default"
+			}
+			result := "pushed"
+			if status := failed[i][registry]; status != "" {
+				result = "**" + status + "**"
+			} else {
+				succeeded++
+			}
+			fmt.Printf("| `%v` | `%v` | %v |\n", image["name"], destination, result)
+		}
+
+		switch policy {
+		case pushPolicyAny:
+			if succeeded == 0 {
+				errs++
+			}
+		default:
+			if succeeded != len(getPushDestinations(image)) {
+				errs++
+			}
 		}
 	}
+	fmt.Printf("\n")
 
 	return
+}
 
+/*
+getPushReferences returns every reference that should be pushed for a single
+image from the inventory.yml file, its name followed by its aliases.
+*/
+func getPushReferences(image map[string]interface{}) (refs []string) {
+	refs = append(refs, image["name"].(string))
+	refs = append(refs, getAliasArray(image)...)
 	return
 }
 
-func pushWorker(input chan Job, output chan Job) {
-	for {
-		job := <-input
+/*
+getPushDestinations returns the registries an image should be pushed to. An
+image without any registries is pushed to wherever its name points, which is
+represented by the empty string.
+*/
+func getPushDestinations(image map[string]interface{}) []string {
+	registries := getRegistryArray(image)
+	if len(registries) == 0 {
+		return []string{""}
+	}
+	return registries
+}
+
+/*
+getPushPolicy returns the push policy for an image, preferring the image's
+`push_policy` key over the policy passed on the command line.
+*/
+func getPushPolicy(image map[string]interface{}, opts TestOpts) string {
+	if policy, ok := image["push_policy"].(string); ok {
+		return policy
+	}
+	return opts.PushPolicy
+}
+
+/*
+validPushPolicy returns true if policy is one dante knows how to apply
+*/
+func validPushPolicy(policy string) bool {
+	return policy == pushPolicyAll || policy == pushPolicyAny
+}
+
+func pushWorker(input chan Job, output chan Job, scheds map[*dockerHost]*scheduler) {
+	for job := range input {
+		sched := scheds[job.Host]
+		if skipped, ok := skipJob(job); ok {
+			output <- skipped
+			continue
+		}
 		var resultString string
 
 		// Initialize Output For Image
 		stdout := fmt.Sprintf("# Pushed image `%v`\n\n## Push Log\n\n", job.Image["name"].(string))
+		if job.Registry != "" {
+			stdout = fmt.Sprintf("# Pushed image `%v` to `%v`\n\n## Push Log\n\n", job.Image["name"].(string), job.Registry)
+		}
+		if job.Host != localHost {
+			stdout = stdout + fmt.Sprintf("Pushing from host `%v`\n\n", job.Host.Name)
+		}
 
+		// Pushes are bound by the network rather than the host, so they are
+		// only limited by --max-pushes
+		sched.acquire(stepPush, Resources{}, job.Priority)
 		resultString, job = HandleSinglePushJob(job)
+		sched.release(stepPush, Resources{})
 
 		stdout = stdout + resultString
 
 		job.Output = stdout
-		output <- job
+		output <- finishJob(job)
+
+	}
+}
 
+/*
+pushRepository returns the registry and repository the reference ref is pushed
+to, when pushed to registry, or to the registry it names if registry is empty
+*/
+func pushRepository(ref string, registry string) string {
+	if registry != "" {
+		ref = registryReference(ref, registry)
 	}
+	registry, repository, _ := resolveReference(ref)
+	return registry + "/" + repository
 }
 
 func HandleSinglePushJob(job Job) (string, Job) {
 
 	var stdout string
 
-	// Attempt to build the image until we run out of retries
-	for retries := job.Retries; retries >= 0; retries-- {
-		// Try to build the image
-		result, err := pushImage(job.Image["name"].(string))
-		stdout = stdout + fmt.Sprintf("```\n%v\n```\n\n", string(result))
+	name := job.Image["name"].(string)
+
+	// When pushing to a specific registry we need to retag the image so that
+	// its name points at that registry before docker will push it there
+	if job.Registry != "" {
+		target := registryReference(name, job.Registry)
+		stdout = stdout + fmt.Sprintf("Tagging `%v` as `%v`\n\n", name, target)
+		result, err := dockerAlias(job.Host, name, target)
+		if err != nil {
+			stdout = stdout + fmt.Sprintf("```\n%v\n```\n\n**Failed** with error: `%v`\n\n", result, err)
+			job.Success = false
+			return stdout, job
+		}
+		name = target
+	}
+
+	// Attempt to push the image until we run out of retries
+	result, _, err := withRetries(getRetries(job.Image, stepPush, job.Retries), isTransient, job.retrying(), func() (string, error) {
+		job.setState(statePushing)
+		return pushImage(name, DockerOpts{
+			Timeout: getTimeout(job.Image),
+			Host:    job.Host,
+			Log:     job.Log,
+		})
+	})
+	stdout = stdout + result
+	job.Success = err == nil
+	job.Cancelled = errors.Is(err, errCancelled)
 
-		// If we fail, determine proper notice to log, else break out of retry loop
+	// Signatures and attestations are about the manifest the registry now
+	// holds, which only exists once the image has been pushed
+	if job.Success && (job.SignKey != "" || job.Attest != "") {
+		digest, err := pushedDigest(job.Host, name, result)
 		if err != nil {
-			stdout = stdout + fmt.Sprintf("**Failed** with error: `%v`\nRetries Remaining: %v", err, retries)
-			if retries == 0 {
-				stdout = stdout + fmt.Sprintf("... Moving on")
+			stdout = stdout + fmt.Sprintf("**Failed** finding the pushed digest of `%v`: `%v`\n\n", name, err)
+			job.Success = false
+			return stdout, job
+		}
+
+		if job.SignKey != "" {
+			result, err := signImage(name, digest, job.SignKey)
+			stdout = stdout + result
+			if err != nil {
+				job.Success = false
+			}
+		}
+
+		if job.Success && job.Attest != "" {
+			result, err := attachAttestations(job.Attest, job.Image["name"].(string), name, digest)
+			stdout = stdout + result
+			if err != nil {
 				job.Success = false
 			}
-			stdout = stdout + fmt.Sprintf("\n\n")
-		} else {
-			job.Success = true
-			break
 		}
 	}
 
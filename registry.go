@@ -0,0 +1,487 @@
+/*
+registry.go contains the logic for working with docker image references and
+the registries they live in
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+splitReference breaks a docker image reference such as
+`registry.example.com:5000/wblankenship/test:1` into its registry, repository
+and tag. Following docker's own rules, the first component of the reference is
+only treated as a registry if it contains a `.` or `:` or is `localhost`.
+Missing components are returned as empty strings.
+*/
+func splitReference(ref string) (registry string, repository string, tag string) {
+	repository = ref
+
+	// Pull the registry off the front of the reference if there is one
+	if i := strings.Index(repository, "/"); i != -1 {
+		first := repository[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			registry = first
+			repository = repository[i+1:]
+		}
+	}
+
+	// A digest reference doesn't have a tag, leave it attached to the
+	// repository so it survives being reassembled
+	if strings.Contains(repository, "@") {
+		return
+	}
+
+	// Since the registry is gone, any remaining `:` separates the tag
+	if i := strings.LastIndex(repository, ":"); i != -1 {
+		tag = repository[i+1:]
+		repository = repository[:i]
+	}
+	return
+}
+
+/*
+registryReference rewrites the reference name so that it points at registry
+instead of the registry it currently names (or docker hub if it doesn't name
+one).
+*/
+func registryReference(name string, registry string) string {
+	_, repository, tag := splitReference(name)
+	ref := strings.TrimSuffix(registry, "/") + "/" + repository
+	if tag != "" {
+		ref = ref + ":" + tag
+	}
+	return ref
+}
+
+/*
+getRegistryArray takes a single image from the inventory.yml file and returns
+the registries it should be pushed to. Both the `registries` and `push_to` keys
+are accepted, and like `test` and `alias` either may be a single string or an
+array of strings.
+*/
+func getRegistryArray(image map[string]interface{}) (registries []string) {
+	registries = append(registries, getStringArray(image, "registries")...)
+	registries = append(registries, getStringArray(image, "push_to")...)
+	return
+}
+
+/*
+dockerHubRegistry is where references without a registry live
+*/
+const dockerHubRegistry = "registry-1.docker.io"
+
+/*
+resolveReference breaks ref into the registry, repository and reference (a tag
+or digest) the registry API expects, filling in docker's defaults: docker hub
+for references without a registry, `library/` for official images and `latest`
+for references without a tag.
+*/
+func resolveReference(ref string) (registry string, repository string, reference string) {
+	registry, repository, reference = splitReference(ref)
+	if i := strings.Index(repository, "@"); i != -1 {
+		reference = repository[i+1:]
+		repository = repository[:i]
+	}
+	if registry == "" || registry == "docker.io" || registry == "index.docker.io" {
+		registry = dockerHubRegistry
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+	if reference == "" {
+		reference = "latest"
+	}
+	return
+}
+
+/*
+manifestMediaTypes are the kinds of manifest dante asks registries for
+*/
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+/*
+registryClient talks to a docker registry over the registry HTTP API
+*/
+type registryClient struct {
+	// Registry is the host (and port) of the registry
+	Registry string
+	// token is the bearer token for the scope we last authenticated for
+	token string
+	http  *http.Client
+	// username and password are looked up once, since a credential helper
+	// is a program of its own
+	username string
+	password string
+	looked   bool
+}
+
+/*
+newRegistryClient returns a client for registry. Registries on the local
+machine are spoken to over plain http, like docker does, and everything else
+over https.
+*/
+func newRegistryClient(registry string) *registryClient {
+	return &registryClient{
+		Registry: registry,
+		http:     &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+/*
+baseURL returns the root of the registry API
+*/
+func (c *registryClient) baseURL() string {
+	host := c.Registry
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	if host == "localhost" || host == "::1" || strings.HasPrefix(host, "127.") {
+		return "http://" + c.Registry + "/v2/"
+	}
+	return "https://" + c.Registry + "/v2/"
+}
+
+/*
+credentials returns the username and password docker has for the registry, the
+same way docker finds them: from the credential helper the config file names
+for the registry, or for every registry, and otherwise from what `docker login`
+stored in the config file itself
+*/
+func (c *registryClient) credentials() (username string, password string) {
+	if !c.looked {
+		c.username, c.password = c.lookupCredentials()
+		c.looked = true
+	}
+	return c.username, c.password
+}
+
+/*
+lookupCredentials does the work of credentials
+*/
+func (c *registryClient) lookupCredentials() (username string, password string) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".docker")
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+		CredsStore  string            `json:"credsStore"`
+		CredHelpers map[string]string `json:"credHelpers"`
+	}
+	if json.Unmarshal(contents, &config) != nil {
+		return
+	}
+
+	keys := []string{c.Registry, "https://" + c.Registry, "http://" + c.Registry}
+	if c.Registry == dockerHubRegistry {
+		keys = append([]string{"https://index.docker.io/v1/"}, append(keys, "docker.io")...)
+	}
+	for _, key := range keys {
+		helper, ok := config.CredHelpers[key]
+		if !ok {
+			helper = config.CredsStore
+		}
+		if helper == "" {
+			continue
+		}
+		if username, password = credentialHelper(helper, key); username != "" {
+			return
+		}
+	}
+	for _, key := range keys {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			continue
+		}
+		pair := strings.SplitN(string(decoded), ":", 2)
+		if len(pair) == 2 {
+			return pair[0], pair[1]
+		}
+	}
+	return
+}
+
+/*
+credentialHelper asks the docker credential helper `docker-credential-helper`
+for the credentials it holds for server. Helpers that hold an identity token
+rather than a password, which registries trade for a token over OAuth, aren't
+supported, and neither return anything.
+*/
+func credentialHelper(helper string, server string) (username string, password string) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	output, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	var credentials struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if json.Unmarshal(output, &credentials) != nil || credentials.Username == "<token>" {
+		return
+	}
+	return credentials.Username, credentials.Secret
+}
+
+/*
+authenticate fetches a bearer token as described by a registry's
+WWW-Authenticate challenge, using the credentials from `docker login` if there
+are any
+*/
+func (c *registryClient) authenticate(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("unsupported authentication challenge: %v", challenge)
+	}
+	params := make(map[string]string)
+	for _, match := range regexp.MustCompile(`(\w+)="([^"]*)"`).FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+	req, err := http.NewRequest("GET", params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if username, password := c.credentials(); username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("authentication failed: %v", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return err
+	}
+	c.token = body.Token
+	if c.token == "" {
+		c.token = body.AccessToken
+	}
+	return nil
+}
+
+/*
+do sends a request to the registry, authenticating and retrying once if the
+registry asks for it. body is sent with every attempt.
+*/
+func (c *registryClient) do(method string, target string, header http.Header, body []byte) (resp *http.Response, err error) {
+	if !strings.HasPrefix(target, "http") {
+		target = c.baseURL() + target
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest(method, target, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		} else if username, password := c.credentials(); username != "" {
+			req.SetBasicAuth(username, password)
+		}
+
+		resp, err = c.http.Do(req)
+		if err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		err = c.authenticate(challenge)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+registryError turns an unexpected response into an error
+*/
+func registryError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("registry responded %v: %v", resp.Status, strings.TrimSpace(string(body)))
+}
+
+/*
+manifestDigest returns the digest of the manifest reference (a tag or digest)
+points to in repository
+*/
+func (c *registryClient) manifestDigest(repository string, reference string) (digest string, err error) {
+	header := http.Header{"Accept": manifestMediaTypes}
+	resp, err := c.do("HEAD", repository+"/manifests/"+reference, header, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry responded %v for %v:%v", resp.Status, repository, reference)
+	}
+	digest = resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry did not return a digest for %v:%v", repository, reference)
+	}
+	return
+}
+
+/*
+getManifest returns the manifest reference points to in repository. A missing
+manifest returns os.ErrNotExist.
+*/
+func (c *registryClient) getManifest(repository string, reference string) (manifest []byte, err error) {
+	header := http.Header{"Accept": manifestMediaTypes}
+	resp, err := c.do("GET", repository+"/manifests/"+reference, header, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, registryError(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+/*
+putManifest uploads manifest to repository under the tag reference
+*/
+func (c *registryClient) putManifest(repository string, reference string, mediaType string, manifest []byte) error {
+	header := http.Header{"Content-Type": {mediaType}}
+	resp, err := c.do("PUT", repository+"/manifests/"+reference, header, manifest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return registryError(resp)
+	}
+	return nil
+}
+
+/*
+getBlob returns the blob with digest from repository, verifying its contents
+match the digest
+*/
+func (c *registryClient) getBlob(repository string, digest string) (blob []byte, err error) {
+	resp, err := c.do("GET", repository+"/blobs/"+digest, nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, registryError(resp)
+	}
+	blob, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if blobDigest(blob) != digest {
+		return nil, fmt.Errorf("blob %v does not match its digest", digest)
+	}
+	return
+}
+
+/*
+putBlob uploads blob to repository with a monolithic upload, returning its
+digest
+*/
+func (c *registryClient) putBlob(repository string, blob []byte) (digest string, err error) {
+	digest = blobDigest(blob)
+
+	resp, err := c.do("POST", repository+"/blobs/uploads/", nil, nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", registryError(resp)
+	}
+
+	// The upload location may be relative to the registry
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return
+	}
+	base, err := url.Parse(c.baseURL())
+	if err != nil {
+		return
+	}
+	location = base.ResolveReference(location)
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err = c.do("PUT", location.String(), header, blob)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", registryError(resp)
+	}
+	return
+}
+
+/*
+blobDigest returns the sha256 digest of blob in the form registries use
+*/
+func blobDigest(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,199 @@
+/*
+retry.go contains the logic for retrying docker commands that fail for reasons
+that might not happen again, such as a registry having a bad moment
+*/
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+/*
+The steps of a job that can be given their own retry counts in the inventory
+with `build_retries`, `test_retries` and `push_retries`
+*/
+const (
+	stepBuild = "build"
+	stepTest  = "test"
+	stepPush  = "push"
+)
+
+var (
+	// retryBaseDelay is how long to wait before the first retry, doubling
+	// with every retry after it
+	retryBaseDelay = 2 * time.Second
+	// retryMaxDelay caps how long any single wait between retries can be
+	retryMaxDelay = time.Minute
+)
+
+/*
+transientErrors are found in the output of docker commands that failed because
+of the network, a registry or the daemon, which are worth retrying
+*/
+var transientErrors = []string{
+	"timed out",
+	"timeout",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"no such host",
+	"temporary failure",
+	"could not resolve",
+	"network is unreachable",
+	"unexpected eof",
+	"tls handshake",
+	"toomanyrequests",
+	"too many requests",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"cannot connect to the docker daemon",
+}
+
+/*
+deterministicErrors are found in the output of docker commands that failed
+because of what they were asked to do, which will fail again the same way no
+matter how many times they are retried. They are checked before
+transientErrors, since a `RUN` step that exits non-zero is the Dockerfile's own
+failure whatever it printed on the way.
+*/
+var deterministicErrors = []string{
+	"returned a non-zero code",
+	"did not complete successfully",
+	"unknown instruction",
+	"dockerfile parse error",
+	// Files missing from the build context, rather than the daemon's socket
+	// missing while it restarts
+	"copy failed",
+	"add failed",
+	"failed to compute cache key",
+	"unable to prepare context",
+	"failed to read dockerfile",
+	// A registry refusing access, rather than any permission being denied,
+	// such as the daemon's socket
+	"pull access denied",
+	"requested access to the resource is denied",
+	"manifest unknown",
+	"unauthorized",
+}
+
+/*
+failureLines is how many lines from the end of a failed command's output are
+read to tell why it failed. Docker prints the reason last, while earlier lines
+echo the Dockerfile and whatever its steps printed, which can mention anything.
+*/
+const failureLines = 5
+
+/*
+retryAnyFailure is used in place of isTransient for steps that should be
+retried however they failed, unless the run has been cancelled
+*/
+func retryAnyFailure(err error, output string) bool {
+	return jobContext.Err() == nil
+}
+
+/*
+isTransient returns true if a docker command that failed with err and printed
+output is worth retrying. Only err and the end of output are read. Failures
+that don't match anything known aren't retried.
+*/
+func isTransient(err error, output string) bool {
+	// Cancelled jobs are meant to stop
+	if jobContext.Err() != nil {
+		return false
+	}
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > failureLines {
+		lines = lines[len(lines)-failureLines:]
+	}
+	text := strings.ToLower(strings.Join(lines, "\n") + "\n" + err.Error())
+	for _, pattern := range deterministicErrors {
+		if strings.Contains(text, pattern) {
+			return false
+		}
+	}
+	for _, pattern := range transientErrors {
+		if strings.Contains(text, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+retryDelay returns how long to wait before retry number attempt, counting from
+zero. The delay doubles with every attempt up to retryMaxDelay, and is spread
+randomly over its upper half so parallel jobs don't all retry at once.
+*/
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 0; i < attempt && delay < retryMaxDelay; i++ {
+		delay = delay * 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+/*
+getRetries returns how many times the step of an image's job should be retried,
+preferring the image's `<step>_retries` key, then its `retries` key, over the
+count passed on the command line
+*/
+func getRetries(image map[string]interface{}, step string, retries int) int {
+	if value, ok := image[step+"_retries"].(int); ok && value >= 0 {
+		return value
+	}
+	if value, ok := image["retries"].(int); ok && value >= 0 {
+		return value
+	}
+	return retries
+}
+
+/*
+withRetries runs attempt until it succeeds, fails in a way that isn't worth
+retrying, or has been retried retries times, waiting longer between each try.
+transient decides which failures are worth retrying, usually isTransient.
+retrying, if it is set, is called before each wait. It returns a markdown log
+of every try, how many tries were made, and the last error, which wraps
+errCancelled if --fail-fast stopped it from trying again.
+*/
+func withRetries(retries int, transient func(err error, output string) bool, retrying func(), attempt func() (string, error)) (output string, attempts int, err error) {
+	for try := 0; ; try++ {
+		var result string
+		attempts++
+		result, err = attempt()
+		output = output + fmt.Sprintf("```\n%v\n```\n\n", result)
+		if err == nil {
+			return
+		}
+
+		remaining := retries - try
+		output = output + fmt.Sprintf("**Failed** with error: `%v`\nRetries Remaining: %v", err, remaining)
+		if remaining <= 0 {
+			output = output + fmt.Sprintf("... Moving on\n\n")
+			return
+		}
+		if !transient(err, result) {
+			output = output + fmt.Sprintf("... Not retrying, this failure would happen again\n\n")
+			return
+		}
+
+		delay := retryDelay(try)
+		output = output + fmt.Sprintf("... Retrying in %v\n\n", delay.Round(time.Millisecond))
+		if retrying != nil {
+			retrying()
+		}
+		select {
+		case <-time.After(delay):
+		case <-jobContext.Done():
+			err = fmt.Errorf("%w before retrying: %v", errCancelled, err)
+			return
+		}
+	}
+}
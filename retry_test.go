@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		err       string
+		output    string
+		transient bool
+	}{
+		{"exit status 1", "Get https://registry/v2/: net/http: TLS handshake timeout", true},
+		{"exit status 1", "toomanyrequests: You have reached your pull rate limit", true},
+		{"exit status 1", "received unexpected HTTP status: 503 Service Unavailable", true},
+		{"exit status 1", "Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?", true},
+		{"exit status 1", "error during connect: dial unix /var/run/docker.sock: connect: no such file or directory\nCannot connect to the Docker daemon", true},
+		{"exit status 1", "The command '/bin/sh -c curl https://example.com' returned a non-zero code: 6\ncould not resolve host", false},
+		{"exit status 1", "process \"/bin/sh -c make\" did not complete successfully: exit code: 2", false},
+		{"exit status 1", "COPY failed: file not found in build context or excluded by .dockerignore: stat app: file does not exist", false},
+		{"exit status 1", "failed to compute cache key: failed to calculate checksum of ref: \"/app\": not found", false},
+		{"exit status 1", "unable to prepare context: unable to evaluate symlinks in Dockerfile path: lstat /src/Dockerfile: no such file or directory", false},
+		{"exit status 1", "pull access denied for private/image, repository does not exist or may require 'docker login'", false},
+		{"exit status 1", "denied: requested access to the resource is denied", false},
+		{"exit status 1", "manifest unknown: manifest unknown", false},
+		{"exit status 1", "something nobody has seen before", false},
+		// Only the end of the output is read
+		{"exit status 1", "Step 1/6 : RUN echo timeout\n2\n3\n4\n5\n6\nunknown instruction: FORM", false},
+		{"signal: killed", "timed out after 10m", true},
+	} {
+		if transient := isTransient(errors.New(test.err), test.output); transient != test.transient {
+			t.Errorf("isTransient(%q, %q) = %v, expected %v", test.err, test.output, transient, test.transient)
+		}
+	}
+}
+
+func TestGetRetries(t *testing.T) {
+	for _, test := range []struct {
+		image    map[string]interface{}
+		step     string
+		expected int
+	}{
+		{map[string]interface{}{}, stepBuild, 3},
+		{map[string]interface{}{"retries": 1}, stepBuild, 1},
+		{map[string]interface{}{"retries": 1, "test_retries": 5}, stepTest, 5},
+		{map[string]interface{}{"retries": 1, "test_retries": 5}, stepPush, 1},
+		{map[string]interface{}{"test_retries": 0}, stepTest, 0},
+	} {
+		if retries := getRetries(test.image, test.step, 3); retries != test.expected {
+			t.Errorf("getRetries(%v, %v, 3) = %v, expected %v", test.image, test.step, retries, test.expected)
+		}
+	}
+}
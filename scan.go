@@ -0,0 +1,478 @@
+/*
+scan.go contains the logic for the scan test kind, which checks a built image
+for known vulnerabilities instead of building layers on top of it
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// scanKind is the kind of a test entry that scans its image
+	scanKind = "scan"
+	// scannerTrivy, scannerGrype and scannerDatabase are the supported scanners
+	scannerTrivy    = "trivy"
+	scannerGrype    = "grype"
+	scannerDatabase = "db"
+	// defaultSeverity is the lowest severity that fails a scan by default
+	defaultSeverity = "HIGH"
+)
+
+/*
+severities lists the severities scanners report, from least to most severe
+*/
+var severities = []string{"UNKNOWN", "NEGLIGIBLE", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+/*
+ScanTest is a single `kind: scan` entry from an image's test key
+*/
+type ScanTest struct {
+	// Scanner is trivy, grype or db
+	Scanner string
+	// Binary is the scanner executable to run, defaulting to Scanner
+	Binary string
+	// Database is the offline vulnerability database used by the db scanner
+	Database string
+	// Severity is the lowest severity that fails the scan
+	Severity string
+	// Allowlist is a file of vulnerability ids that never fail the scan
+	Allowlist string
+	// Quarantine reports the scan's failures without failing the image
+	Quarantine bool
+}
+
+/*
+Finding is a single vulnerability found in an image
+*/
+type Finding struct {
+	Id       string
+	Package  string
+	Version  string
+	FixedIn  string
+	Severity string
+	Title    string
+}
+
+/*
+DatabaseEntry is a single vulnerability in an offline database file. It
+matches any installed package with the same name and one of the listed
+versions.
+*/
+type DatabaseEntry struct {
+	Id       string   `json:"id"`
+	Package  string   `json:"package"`
+	Manager  string   `json:"manager"`
+	Versions []string `json:"versions"`
+	FixedIn  string   `json:"fixed"`
+	Severity string   `json:"severity"`
+	Title    string   `json:"title"`
+}
+
+/*
+getTestEntries returns the raw entries of an image's test key, which may be a
+single entry or a list of them
+*/
+func getTestEntries(image map[string]interface{}) []interface{} {
+	switch image["test"].(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return image["test"].([]interface{})
+	}
+	return []interface{}{image["test"]}
+}
+
+/*
+getScanTests returns the scan entries of an image's test key. Entries that
+aren't valid scans are skipped, and left for verifyInventory to report.
+*/
+func getScanTests(image map[string]interface{}) (scans []ScanTest) {
+	for _, entry := range getTestEntries(image) {
+		fields, ok := yamlMap(entry)
+		if !ok || fields["kind"] != scanKind {
+			continue
+		}
+		scan := ScanTest{Severity: defaultSeverity}
+		scan.Scanner, _ = fields["scanner"].(string)
+		scan.Binary, _ = fields["binary"].(string)
+		scan.Database, _ = fields["db"].(string)
+		scan.Allowlist, _ = fields["allowlist"].(string)
+		scan.Quarantine, _ = fields["quarantine"].(bool)
+		if severity, ok := fields["severity"].(string); ok {
+			scan.Severity = strings.ToUpper(severity)
+		}
+		// Pointing at a database file is enough to pick the db scanner
+		if scan.Scanner == "" && scan.Database != "" {
+			scan.Scanner = scannerDatabase
+		}
+		if scan.Scanner == "" {
+			scan.Scanner = scannerTrivy
+		}
+		if scan.Binary == "" {
+			scan.Binary = scan.Scanner
+		}
+		scans = append(scans, scan)
+	}
+	return
+}
+
+/*
+verifyTestEntry returns a description of what is wrong with a single entry of
+an image's test key, or the empty string if nothing is
+*/
+func verifyTestEntry(entry interface{}) string {
+	if _, ok := entry.(string); ok {
+		return ""
+	}
+	fields, ok := yamlMap(entry)
+	if !ok {
+		return fmt.Sprintf("`%v` isn't a path or a map", entry)
+	}
+	if _, ok := fields["quarantine"]; ok {
+		if _, ok := fields["quarantine"].(bool); !ok {
+			return "quarantine isn't true or false"
+		}
+	}
+	// Maps without a kind are Dockerfile tests with extra settings
+	if _, ok := fields["kind"]; !ok {
+		if path, ok := fields["path"].(string); !ok || path == "" {
+			return "test is missing a path"
+		}
+		return ""
+	}
+	if fields["kind"] != scanKind {
+		return fmt.Sprintf("unknown kind `%v`", fields["kind"])
+	}
+	for _, key := range []string{"scanner", "binary", "db", "severity", "allowlist"} {
+		if _, ok := fields[key]; !ok {
+			continue
+		}
+		if _, ok := fields[key].(string); !ok {
+			return fmt.Sprintf("scan test has a %v that isn't a string", key)
+		}
+	}
+
+	scanner, _ := fields["scanner"].(string)
+	db, _ := fields["db"].(string)
+	switch scanner {
+	case scannerTrivy, scannerGrype:
+	case "", scannerDatabase:
+		if scanner == scannerDatabase && db == "" {
+			return "scan test uses the db scanner without a db file"
+		}
+	default:
+		return fmt.Sprintf("scan test has an unknown scanner `%v`", scanner)
+	}
+	if db != "" {
+		if _, err := os.Stat(db); err != nil {
+			return fmt.Sprintf("scan test's db `%v` doesn't exist", db)
+		}
+	}
+	if allowlist, _ := fields["allowlist"].(string); allowlist != "" {
+		if _, err := os.Stat(allowlist); err != nil {
+			return fmt.Sprintf("scan test's allowlist `%v` doesn't exist", allowlist)
+		}
+	}
+	if severity, ok := fields["severity"].(string); ok && severityRank(severity) < 0 {
+		return fmt.Sprintf("scan test has an unknown severity `%v`", severity)
+	}
+	return ""
+}
+
+/*
+resolveTestEntryPaths returns a copy of the test entry fields with its path, db
+and allowlist made relative to dir
+*/
+func resolveTestEntryPaths(fields map[string]interface{}, dir string) map[string]interface{} {
+	resolved := make(map[string]interface{})
+	for key, value := range fields {
+		resolved[key] = value
+	}
+	for _, key := range []string{"path", "db", "allowlist"} {
+		if path, ok := resolved[key].(string); ok && path != "" {
+			resolved[key] = resolvePath(dir, path)
+		}
+	}
+	return resolved
+}
+
+/*
+severityRank returns the position of severity in severities, or -1 if it isn't
+one of them
+*/
+func severityRank(severity string) int {
+	severity = strings.ToUpper(severity)
+	for i, known := range severities {
+		if known == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+readAllowlist reads the vulnerability ids in the file at path, one per line.
+Blank lines and anything after a `#` are ignored, so each id can be followed
+by the reason it was accepted.
+*/
+func readAllowlist(path string) (allowed map[string]bool, err error) {
+	allowed = make(map[string]bool)
+	if path == "" {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if id := strings.TrimSpace(line); id != "" {
+			allowed[id] = true
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+/*
+execScanner runs a scanner binary against the daemon on host and returns what it
+wrote to stdout, which is where both trivy and grype write their JSON reports
+*/
+func execScanner(host *dockerHost, timeout time.Duration, binary string, args ...string) (output []byte, err error) {
+	ctx := jobContext
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Env = host.env()
+	cmd.Stderr = &stderr
+	output, err = cmd.Output()
+	if stoppedBy(jobContext, err) {
+		err = fmt.Errorf("%v %w", binary, errCancelled)
+	} else if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%v timed out after %v", binary, timeout)
+	} else if err != nil {
+		err = fmt.Errorf("%v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return
+}
+
+/*
+parseTrivy reads the findings from a `trivy image --format json` report
+*/
+func parseTrivy(report []byte) (findings []Finding, err error) {
+	var parsed struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				FixedVersion     string
+				Severity         string
+				Title            string
+			}
+		}
+	}
+	err = json.Unmarshal(report, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("could not read trivy report: %v", err)
+	}
+	for _, result := range parsed.Results {
+		for _, vuln := range result.Vulnerabilities {
+			findings = append(findings, Finding{
+				Id:       vuln.VulnerabilityID,
+				Package:  vuln.PkgName,
+				Version:  vuln.InstalledVersion,
+				FixedIn:  vuln.FixedVersion,
+				Severity: strings.ToUpper(vuln.Severity),
+				Title:    vuln.Title,
+			})
+		}
+	}
+	return
+}
+
+/*
+parseGrype reads the findings from a `grype -o json` report
+*/
+func parseGrype(report []byte) (findings []Finding, err error) {
+	var parsed struct {
+		Matches []struct {
+			Vulnerability struct {
+				Id          string `json:"id"`
+				Severity    string `json:"severity"`
+				Description string `json:"description"`
+				Fix         struct {
+					Versions []string `json:"versions"`
+				} `json:"fix"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}
+	err = json.Unmarshal(report, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("could not read grype report: %v", err)
+	}
+	for _, match := range parsed.Matches {
+		findings = append(findings, Finding{
+			Id:       match.Vulnerability.Id,
+			Package:  match.Artifact.Name,
+			Version:  match.Artifact.Version,
+			FixedIn:  strings.Join(match.Vulnerability.Fix.Versions, ", "),
+			Severity: strings.ToUpper(match.Vulnerability.Severity),
+			Title:    match.Vulnerability.Description,
+		})
+	}
+	return
+}
+
+/*
+scanDatabase matches the packages installed in image against the offline
+vulnerability database at path
+*/
+func scanDatabase(host *dockerHost, path string, image string) (findings []Finding, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var entries []DatabaseEntry
+	err = json.Unmarshal(contents, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("could not read database `%v`: %v", path, err)
+	}
+
+	packages, err := listPackages(host, image)
+	if err != nil {
+		return
+	}
+	for _, pkg := range packages {
+		for _, entry := range entries {
+			if entry.Package != pkg.Name || (entry.Manager != "" && entry.Manager != pkg.Manager) {
+				continue
+			}
+			affected := false
+			for _, version := range entry.Versions {
+				if version == pkg.Version {
+					affected = true
+				}
+			}
+			if !affected {
+				continue
+			}
+			findings = append(findings, Finding{
+				Id:       entry.Id,
+				Package:  pkg.Name,
+				Version:  pkg.Version,
+				FixedIn:  entry.FixedIn,
+				Severity: strings.ToUpper(entry.Severity),
+				Title:    entry.Title,
+			})
+		}
+	}
+	return
+}
+
+/*
+runScanner scans image with the scanner configured by scan and returns what it
+found, most severe first
+*/
+func runScanner(host *dockerHost, scan ScanTest, image string, timeout time.Duration) (findings []Finding, err error) {
+	var report []byte
+	switch scan.Scanner {
+	case scannerTrivy:
+		report, err = execScanner(host, timeout, scan.Binary, "image", "--quiet", "--format", "json", image)
+		if err == nil {
+			findings, err = parseTrivy(report)
+		}
+	case scannerGrype:
+		report, err = execScanner(host, timeout, scan.Binary, "docker:"+image, "--quiet", "-o", "json")
+		if err == nil {
+			findings, err = parseGrype(report)
+		}
+	case scannerDatabase:
+		findings, err = scanDatabase(host, scan.Database, image)
+	default:
+		err = fmt.Errorf("unknown scanner `%v`", scan.Scanner)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if severityRank(findings[i].Severity) != severityRank(findings[j].Severity) {
+			return severityRank(findings[i].Severity) > severityRank(findings[j].Severity)
+		}
+		return findings[i].Id < findings[j].Id
+	})
+	return
+}
+
+/*
+testScan runs a single scan test against the image built for image, and fails
+if it finds anything at or above the scan's severity that isn't allowlisted.
+Findings are reported as a table rather than the scanner's own output.
+*/
+func testScan(host *dockerHost, image ImageDefinition, scanNum int, scan ScanTest) (output string, err error) {
+	name := image["name"].(string)
+	output = fmt.Sprintf("## Running scan #%v\n\n", scanNum)
+	output = output + fmt.Sprintf("Scanning `%v` with `%v`, failing on `%v` and above\n\n", name, scan.Scanner, scan.Severity)
+
+	allowed, err := readAllowlist(scan.Allowlist)
+	if err != nil {
+		output = output + fmt.Sprintf("**Failed** Could not read allowlist `%v`: `%v`\n\n", scan.Allowlist, err)
+		return
+	}
+
+	findings, err := runScanner(host, scan, name, getTimeout(image))
+	if err != nil {
+		output = output + fmt.Sprintf("**Failed** with error: `%v`\n\n", err)
+		return
+	}
+	if len(findings) == 0 {
+		output = output + fmt.Sprintf("No vulnerabilities found\n\n")
+		return
+	}
+
+	threshold := severityRank(scan.Severity)
+	failing := 0
+	output = output + fmt.Sprintf("| Id | Package | Installed | Fixed In | Severity | Status |\n")
+	output = output + fmt.Sprintf("|----|---------|-----------|----------|----------|--------|\n")
+	for _, finding := range findings {
+		status := "below threshold"
+		if allowed[finding.Id] {
+			status = "allowed"
+		} else if severityRank(finding.Severity) >= threshold {
+			status = "**failed**"
+			failing++
+		}
+		output = output + fmt.Sprintf("| %v | %v | %v | %v | %v | %v |\n", finding.Id, finding.Package, finding.Version, finding.FixedIn, finding.Severity, status)
+	}
+	output = output + fmt.Sprintf("\n")
+
+	if failing > 0 {
+		err = fmt.Errorf("%v vulnerabilities at or above %v", failing, scan.Severity)
+		output = output + fmt.Sprintf("**Failed** with error: `%v`\n\n", err)
+	}
+	return
+}
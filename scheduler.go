@@ -0,0 +1,456 @@
+/*
+scheduler.go contains the logic for deciding when jobs may run, so that the
+builds, tests and pushes running at once fit on the host
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Resources is an amount of the host's CPU and memory
+*/
+type Resources struct {
+	CPUs float64
+	// Memory is in bytes, zero means unknown or unlimited
+	Memory int64
+}
+
+/*
+hostCapacity returns the resources of the docker host host. Remote hosts are
+asked with `docker info`, and if they can't be reached the error is returned
+along with a single CPU, so jobs can still be scheduled. For the local host,
+memory is read from /proc/meminfo, and is zero where that doesn't exist.
+*/
+func hostCapacity(host *dockerHost) (capacity Resources, err error) {
+	if host.args() != nil {
+		capacity.CPUs = 1
+		output, err := execDocker(host, "/", "info", "--format", "{{.NCPU}} {{.MemTotal}}")
+		if err != nil {
+			return capacity, fmt.Errorf("%v: %v", err, strings.TrimSpace(output))
+		}
+		if _, err = fmt.Sscan(output, &capacity.CPUs, &capacity.Memory); err != nil {
+			return Resources{CPUs: 1}, fmt.Errorf("could not read `%v`: %v", strings.TrimSpace(output), err)
+		}
+		return capacity, nil
+	}
+
+	capacity.CPUs = float64(runtime.NumCPU())
+
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kilobytes, _ := strconv.ParseInt(fields[1], 10, 64)
+			capacity.Memory = kilobytes * 1024
+		}
+	}
+	return
+}
+
+/*
+getNumber reads a number that YAML may have decoded as an int or a float
+*/
+func getNumber(value interface{}) (number float64, ok bool) {
+	switch value.(type) {
+	case int:
+		return float64(value.(int)), true
+	case float64:
+		return value.(float64), true
+	}
+	return 0, false
+}
+
+/*
+getResources returns what a single job for image needs from the host, from its
+`cpus` and `memory` keys. `weight` stands in for `cpus` when it isn't set, and
+jobs that set neither count as one CPU.
+*/
+func getResources(image map[string]interface{}) (resources Resources) {
+	resources.CPUs = 1
+	if weight, ok := getNumber(image["weight"]); ok {
+		resources.CPUs = weight
+	}
+	if cpus, ok := getNumber(image["cpus"]); ok {
+		resources.CPUs = cpus
+	}
+	if _, ok := image["memory"]; ok {
+		resources.Memory, _ = parseSize(image["memory"])
+	}
+	return
+}
+
+/*
+verifyResources returns a description of what is wrong with the scheduling
+hints of image, or the empty string if nothing is
+*/
+func verifyResources(image map[string]interface{}) string {
+	for _, key := range []string{"weight", "cpus"} {
+		if _, ok := image[key]; !ok {
+			continue
+		}
+		if number, ok := getNumber(image[key]); !ok || number <= 0 {
+			return fmt.Sprintf("%v that isn't a positive number", key)
+		}
+	}
+	if value, ok := image["memory"]; ok {
+		if _, err := parseSize(value); err != nil {
+			return fmt.Sprintf("memory %v", err)
+		}
+	}
+	if value, ok := image["priority"]; ok {
+		if _, ok := value.(int); !ok {
+			return "priority that isn't a whole number"
+		}
+	}
+	return ""
+}
+
+/*
+getPriorities returns the priority each image in inventory is started with,
+higher first. An image's priority is the highest of its own `priority` key and
+the priorities of every image built FROM it, so the parents of a long build
+are never held back behind shorter ones.
+*/
+func getPriorities(inventory Inventory) (priorities map[string]int) {
+	priorities = make(map[string]int)
+	own := make(map[string]int)
+	for _, image := range inventory["images"] {
+		own[image["name"].(string)], _ = image["priority"].(int)
+	}
+
+	// Without a graph, images still get their own priorities
+	graph, err := buildImageGraph(inventory)
+	if err != nil {
+		return own
+	}
+
+	var resolve func(name string, seen map[string]bool) int
+	resolve = func(name string, seen map[string]bool) int {
+		if priority, ok := priorities[name]; ok {
+			return priority
+		}
+		priority := own[name]
+		seen[name] = true
+		for _, child := range graph.Children[name] {
+			if seen[child] {
+				continue
+			}
+			if childPriority := resolve(child, seen); childPriority > priority {
+				priority = childPriority
+			}
+		}
+		priorities[name] = priority
+		return priority
+	}
+	for name := range own {
+		resolve(name, make(map[string]bool))
+	}
+	return
+}
+
+/*
+priorityOrder returns the indexes of the images in inventory in the order they
+should be started, highest priority first and otherwise in inventory order
+*/
+func priorityOrder(inventory Inventory, priorities map[string]int) (order []int) {
+	for i := range inventory["images"] {
+		order = append(order, i)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return priorities[inventory["images"][order[i]]["name"].(string)] > priorities[inventory["images"][order[j]]["name"].(string)]
+	})
+	return
+}
+
+/*
+workerCount returns how many workers to start for jobs jobs. With -j the count
+is fixed, otherwise there is a worker for every job and the scheduler alone
+decides how many run at once.
+*/
+func workerCount(opts TestOpts, jobs int) int {
+	if opts.Threads > 0 {
+		return opts.Threads
+	}
+	if jobs < 1 {
+		return 1
+	}
+	return jobs
+}
+
+/*
+buildParents returns the image each of the images named in run is built FROM,
+for those whose parent is also in run. Images built FROM each other in a cycle
+would wait on each other forever, so they are left out, as is everything when
+the graph can't be read, and those images are built in any order.
+*/
+func buildParents(inventory Inventory, run map[string]bool) (parents map[string]string) {
+	parents = make(map[string]string)
+	graph, err := buildImageGraph(inventory)
+	if err != nil {
+		return
+	}
+	for name := range run {
+		parent, ok := graph.Parents[name]
+		if !ok || !run[parent] {
+			continue
+		}
+		seen := map[string]bool{name: true}
+		next := parent
+		for next != "" && !seen[next] {
+			seen[next] = true
+			next = graph.Parents[next]
+		}
+		if next != name {
+			parents[name] = parent
+		}
+	}
+	return
+}
+
+/*
+buildOrder holds back jobs whose image is built FROM another image in the run
+until that image has built, so nothing is built on a stale or missing parent.
+Jobs whose parent failed to build are handed to fail instead of being run.
+*/
+type buildOrder struct {
+	mutex   sync.Mutex
+	parents map[string]string
+	// built records whether each image built, once that is known
+	built   map[string]bool
+	waiting map[string][]Job
+	queue   func(job Job)
+	fail    func(job Job, parent string)
+}
+
+func newBuildOrder(parents map[string]string, queue func(job Job), fail func(job Job, parent string)) *buildOrder {
+	return &buildOrder{
+		parents: parents,
+		built:   make(map[string]bool),
+		waiting: make(map[string][]Job),
+		queue:   queue,
+		fail:    fail,
+	}
+}
+
+/*
+add queues job, or holds it back until its parent has built. It blocks until a
+worker takes the job if it is queued straight away.
+*/
+func (order *buildOrder) add(job Job) {
+	name := job.Image["name"].(string)
+	order.mutex.Lock()
+	parent, ok := order.parents[name]
+	success, known := order.built[parent]
+	if ok && !known {
+		order.waiting[parent] = append(order.waiting[parent], job)
+	}
+	order.mutex.Unlock()
+
+	switch {
+	case ok && !known:
+	case ok && !success:
+		order.fail(job, parent)
+	default:
+		order.queue(job)
+	}
+}
+
+/*
+finished records whether the image called name built, releasing the jobs that
+were waiting on it. Only the first call for an image counts, so it can be
+called again once the image's job is done without changing anything.
+*/
+func (order *buildOrder) finished(name string, success bool) {
+	order.mutex.Lock()
+	if _, known := order.built[name]; known {
+		order.mutex.Unlock()
+		return
+	}
+	order.built[name] = success
+	waiting := order.waiting[name]
+	delete(order.waiting, name)
+	order.mutex.Unlock()
+
+	for _, job := range waiting {
+		if success {
+			go order.queue(job)
+		} else {
+			go order.fail(job, name)
+		}
+	}
+}
+
+/*
+scheduler hands out the host's resources to jobs. A job may start once its kind
+is under its concurrency limit and the resources it needs are free, and jobs
+waiting to start are let through highest priority first.
+*/
+type scheduler struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	capacity Resources
+	used     Resources
+	// limits caps how many jobs of each kind run at once, zero is no limit
+	limits  map[string]int
+	running map[string]int
+	waiting []*schedulerWaiter
+	tickets int
+	// err is why the host's capacity couldn't be found, if it couldn't
+	err error
+}
+
+/*
+schedulerWaiter is a job waiting to be let through by a scheduler
+*/
+type schedulerWaiter struct {
+	kind     string
+	demand   Resources
+	priority int
+	// ticket orders waiters with the same priority by when they arrived
+	ticket int
+}
+
+/*
+newScheduler creates a scheduler sharing capacity between jobs, with limits on
+how many jobs of each kind (stepBuild, stepTest or stepPush) may run at once
+*/
+func newScheduler(capacity Resources, limits map[string]int) *scheduler {
+	s := &scheduler{
+		capacity: capacity,
+		limits:   limits,
+		running:  make(map[string]int),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+/*
+ahead returns true if a should be let through before b
+*/
+func (a *schedulerWaiter) ahead(b *schedulerWaiter) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.ticket < b.ticket
+}
+
+/*
+slotFree returns true if another job of kind may run. The caller must hold the
+mutex.
+*/
+func (s *scheduler) slotFree(kind string) bool {
+	return s.limits[kind] <= 0 || s.running[kind] < s.limits[kind]
+}
+
+/*
+canRun returns true if waiter may start now. The caller must hold the mutex.
+*/
+func (s *scheduler) canRun(waiter *schedulerWaiter) bool {
+	if !s.slotFree(waiter.kind) {
+		return false
+	}
+	// Only the first waiter in line gets the resources, so small jobs can't
+	// keep a large one waiting forever
+	for _, other := range s.waiting {
+		if other != waiter && s.slotFree(other.kind) && other.ahead(waiter) {
+			return false
+		}
+	}
+	running := 0
+	for _, count := range s.running {
+		running += count
+	}
+	// A job always fits on an idle host, however large it is
+	if running == 0 {
+		return true
+	}
+	if s.used.CPUs+waiter.demand.CPUs > s.capacity.CPUs {
+		return false
+	}
+	if s.capacity.Memory > 0 && s.used.Memory+waiter.demand.Memory > s.capacity.Memory {
+		return false
+	}
+	return true
+}
+
+/*
+acquire blocks until a job of kind needing demand may run. Every acquire must
+be followed by a release with the same kind and demand.
+*/
+func (s *scheduler) acquire(kind string, demand Resources, priority int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	waiter := &schedulerWaiter{kind: kind, demand: demand, priority: priority, ticket: s.tickets}
+	s.tickets++
+	s.waiting = append(s.waiting, waiter)
+	for !s.canRun(waiter) {
+		s.cond.Wait()
+	}
+
+	for i, other := range s.waiting {
+		if other == waiter {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			break
+		}
+	}
+	s.running[kind]++
+	s.used.CPUs += demand.CPUs
+	s.used.Memory += demand.Memory
+	// Whoever is next in line may be able to start alongside us
+	s.cond.Broadcast()
+}
+
+/*
+release hands back what a job acquired once it is finished
+*/
+func (s *scheduler) release(kind string, demand Resources) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.running[kind]--
+	s.used.CPUs -= demand.CPUs
+	s.used.Memory -= demand.Memory
+	s.cond.Broadcast()
+}
+
+/*
+describe summarizes the capacity and limits of the scheduler for the report
+*/
+func (s *scheduler) describe() string {
+	memory := "unknown memory"
+	if s.capacity.Memory > 0 {
+		memory = formatSize(s.capacity.Memory) + " of memory"
+	}
+	limits := []string{}
+	for _, kind := range []struct{ Step, Plural string }{
+		{stepBuild, "builds"},
+		{stepTest, "tests"},
+		{stepPush, "pushes"},
+	} {
+		if s.limits[kind.Step] > 0 {
+			limits = append(limits, fmt.Sprintf("%v %v", s.limits[kind.Step], kind.Plural))
+		}
+	}
+	description := fmt.Sprintf("Scheduling jobs on %v CPUs and %v", s.capacity.CPUs, memory)
+	if s.err != nil {
+		description = fmt.Sprintf("**Failed** asking the host for its CPUs and memory: `%v`\n\n", s.err) + description
+	}
+	if len(limits) > 0 {
+		description = description + ", running at most " + strings.Join(limits, ", ") + " at once"
+	}
+	return description + "\n\n"
+}
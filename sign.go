@@ -0,0 +1,340 @@
+/*
+sign.go contains the logic for signing pushed images and verifying those
+signatures. Signatures are stored in the registry the way cosign stores them,
+so images signed by dante can be verified by cosign and vice versa.
+*/
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// signatureMediaType is the media type of a cosign simple signing payload
+	signatureMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// signatureAnnotation holds the base64 signature of a payload
+	signatureAnnotation = "dev.cosignproject.cosign/signature"
+	// signatureType identifies a payload as an image signature
+	signatureType = "cosign container image signature"
+	// ociManifestMediaType is the media type of the manifest holding signatures
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	// ociConfigMediaType is the media type of that manifest's config
+	ociConfigMediaType = "application/vnd.oci.image.config.v1+json"
+)
+
+/*
+signingPayload is the simple signing payload that is actually signed. It binds
+the signature to a repository and the digest of the manifest pushed to it.
+*/
+type signingPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+/*
+ociDescriptor points at a blob from a manifest
+*/
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Size        int               `json:"size"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+/*
+ociManifest is an OCI image manifest
+*/
+type ociManifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	// ArtifactType and Subject are only set for artifacts attached to
+	// another manifest, such as attestations
+	ArtifactType string          `json:"artifactType,omitempty"`
+	Config       ociDescriptor   `json:"config"`
+	Layers       []ociDescriptor `json:"layers"`
+	Subject      *ociDescriptor  `json:"subject,omitempty"`
+}
+
+/*
+loadSigningKey reads a PEM encoded ECDSA or ed25519 private key from path, in
+either PKCS8 (`PRIVATE KEY`) or SEC1 (`EC PRIVATE KEY`) form. Password
+protected keys, such as those generated by `cosign generate-key-pair`, are not
+supported.
+*/
+func loadSigningKey(path string) (key crypto.Signer, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%v is not a PEM encoded key", path)
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return
+		}
+		switch parsed.(type) {
+		case *ecdsa.PrivateKey, ed25519.PrivateKey:
+			return parsed.(crypto.Signer), nil
+		}
+	}
+	return nil, fmt.Errorf("%v must be an unencrypted ECDSA or ed25519 private key", path)
+}
+
+/*
+loadVerifyingKey reads a PEM encoded ECDSA or ed25519 public key from path
+*/
+func loadVerifyingKey(path string) (key crypto.PublicKey, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%v is not a PEM encoded public key", path)
+	}
+	key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%v must be an ECDSA or ed25519 public key", path)
+}
+
+/*
+signPayload signs payload with key. ECDSA keys sign the payload's sha256 while
+ed25519 keys sign the payload itself, matching cosign.
+*/
+func signPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+/*
+verifyPayload checks signature is a signature of payload by key
+*/
+func verifyPayload(key crypto.PublicKey, payload []byte, signature []byte) bool {
+	switch key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key.(ed25519.PublicKey), payload, signature)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		return ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature)
+	}
+	return false
+}
+
+/*
+signatureTag returns the tag the signatures for the manifest digest are stored
+under, such as `sha256-abc....sig`
+*/
+func signatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+/*
+signImage signs the manifest digest, which was just pushed to ref, with the
+private key at keyPath, and pushes the signature next to it. The digest comes
+from the push rather than the registry, so a push of the same tag by someone
+else in between can't get their image signed. It returns a markdown log of what
+it did.
+*/
+func signImage(ref string, digest string, keyPath string) (output string, err error) {
+	output = fmt.Sprintf("## Signing\n\n")
+	fail := func(format string, args ...interface{}) (string, error) {
+		err = fmt.Errorf(format, args...)
+		return output + fmt.Sprintf("**Failed** signing `%v`: `%v`\n\n", ref, err), err
+	}
+
+	key, err := loadSigningKey(keyPath)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	registry, repository, _ := resolveReference(ref)
+	client := newRegistryClient(registry)
+
+	var payload signingPayload
+	payload.Critical.Identity.DockerReference = registry + "/" + repository
+	payload.Critical.Image.DockerManifestDigest = digest
+	payload.Critical.Type = signatureType
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fail("%v", err)
+	}
+	signature, err := signPayload(key, payloadBytes)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	// The signature is pushed as an image whose only layer is the payload,
+	// with the signature itself in the layer's annotations
+	layerDigest, err := client.putBlob(repository, payloadBytes)
+	if err != nil {
+		return fail("uploading payload: %v", err)
+	}
+	layer := ociDescriptor{
+		MediaType: signatureMediaType,
+		Size:      len(payloadBytes),
+		Digest:    layerDigest,
+		Annotations: map[string]string{
+			signatureAnnotation: base64.StdEncoding.EncodeToString(signature),
+		},
+	}
+
+	// Keep any signatures already made for this digest, by other keys or
+	// earlier pushes, alongside ours
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+	}
+	existing, err := client.getManifest(repository, signatureTag(digest))
+	if err == nil {
+		err = json.Unmarshal(existing, &manifest)
+	}
+	if err != nil && err != os.ErrNotExist {
+		return fail("reading existing signatures: %v", err)
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+
+	diffIds := []string{}
+	for _, layer := range manifest.Layers {
+		diffIds = append(diffIds, layer.Digest)
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "",
+		"os":           "",
+		"config":       map[string]interface{}{},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": diffIds,
+		},
+	})
+	if err != nil {
+		return fail("%v", err)
+	}
+	configDigest, err := client.putBlob(repository, config)
+	if err != nil {
+		return fail("uploading config: %v", err)
+	}
+	manifest.Config = ociDescriptor{
+		MediaType: ociConfigMediaType,
+		Size:      len(config),
+		Digest:    configDigest,
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return fail("%v", err)
+	}
+	err = client.putManifest(repository, signatureTag(digest), ociManifestMediaType, manifestBytes)
+	if err != nil {
+		return fail("uploading signature: %v", err)
+	}
+
+	output = output + fmt.Sprintf("Signed `%v@%v` as `%v:%v`\n\n", registry+"/"+repository, digest, registry+"/"+repository, signatureTag(digest))
+	return
+}
+
+/*
+verifyImage checks that the manifest ref points to in its registry has a valid
+signature made by the public key at keyPath. It returns a markdown log of what
+it found.
+*/
+func verifyImage(ref string, keyPath string) (output string, err error) {
+	fail := func(format string, args ...interface{}) (string, error) {
+		err = fmt.Errorf(format, args...)
+		return output + fmt.Sprintf("**Failed** verifying `%v`: `%v`\n\n", ref, err), err
+	}
+
+	key, err := loadVerifyingKey(keyPath)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	registry, repository, reference := resolveReference(ref)
+	client := newRegistryClient(registry)
+	digest, err := client.manifestDigest(repository, reference)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	manifestBytes, err := client.getManifest(repository, signatureTag(digest))
+	if err == os.ErrNotExist {
+		return fail("no signatures found for %v", digest)
+	}
+	if err != nil {
+		return fail("%v", err)
+	}
+	var manifest ociManifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return fail("bad signature manifest: %v", err)
+	}
+
+	// Any one valid signature for this exact digest and repository is enough
+	for _, layer := range manifest.Layers {
+		encoded, ok := layer.Annotations[signatureAnnotation]
+		if !ok {
+			continue
+		}
+		signature, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			continue
+		}
+		payloadBytes, blobErr := client.getBlob(repository, layer.Digest)
+		if blobErr != nil || !verifyPayload(key, payloadBytes, signature) {
+			continue
+		}
+		var payload signingPayload
+		if json.Unmarshal(payloadBytes, &payload) != nil {
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest != digest {
+			continue
+		}
+		// The signature must have been made for this repository, not just for
+		// the same image pushed somewhere else
+		identityRegistry, identityRepository, _ := resolveReference(payload.Critical.Identity.DockerReference)
+		if identityRegistry != registry || identityRepository != repository {
+			continue
+		}
+		output = output + fmt.Sprintf("Verified `%v@%v`\n\n", registry+"/"+repository, digest)
+		return output, nil
+	}
+
+	return fail("no valid signature by %v found for %v", keyPath, digest)
+}
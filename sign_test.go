@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/*
+fakeRegistry is a stand-in for a docker registry that keeps blobs and manifests
+in memory, implementing just enough of the registry API for signing
+*/
+type fakeRegistry struct {
+	mutex     sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+}
+
+func (registry *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case strings.HasSuffix(path, "/blobs/uploads/") && r.Method == "POST":
+		w.Header().Set("Location", "/v2/"+path+"upload")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/uploads/") && r.Method == "PUT":
+		blob, _ := ioutil.ReadAll(r.Body)
+		digest := r.URL.Query().Get("digest")
+		if blobDigest(blob) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		registry.blobs[digest] = blob
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		blob, ok := registry.blobs[path[strings.LastIndex(path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	case strings.Contains(path, "/manifests/") && r.Method == "PUT":
+		manifest, _ := ioutil.ReadAll(r.Body)
+		registry.manifests[path] = manifest
+		// Manifests can be fetched by their digest as well as their tag
+		repository := path[:strings.Index(path, "/manifests/")]
+		registry.manifests[repository+"/manifests/"+blobDigest(manifest)] = manifest
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/manifests/"):
+		manifest, ok := registry.manifests[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", blobDigest(manifest))
+		if r.Method == "GET" {
+			w.Write(manifest)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+/*
+imageManifestDigest is the digest of the manifest startRegistry pushes
+*/
+var imageManifestDigest = blobDigest([]byte(`{"schemaVersion":2}`))
+
+/*
+startRegistry starts a fakeRegistry holding an image at `test/image:1`, and
+returns the address it is listening on
+*/
+func startRegistry(t *testing.T) (registry *fakeRegistry, address string) {
+	// Keep any credentials from `docker login` on this machine out of the test
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	registry = &fakeRegistry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+	}
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+
+	// Registries on localhost are spoken to over plain http
+	address = strings.Replace(strings.TrimPrefix(server.URL, "http://"), "127.0.0.1", "localhost", 1)
+	err := newRegistryClient(address).putManifest("test/image", "1", ociManifestMediaType, []byte(`{"schemaVersion":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+/*
+writeKeyPair writes key and its public half to PEM files in a temporary
+directory, returning their paths
+*/
+func writeKeyPair(t *testing.T, key crypto.Signer) (private string, public string) {
+	dir := t.TempDir()
+	privateBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicBytes, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	private = filepath.Join(dir, "key.pem")
+	public = filepath.Join(dir, "key.pub")
+	err = ioutil.WriteFile(private, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateBytes}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(public, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func newECDSAKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) crypto.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for name, key := range map[string]crypto.Signer{"ecdsa": newECDSAKey(t), "ed25519": newEd25519Key(t)} {
+		t.Run(name, func(t *testing.T) {
+			_, address := startRegistry(t)
+			private, public := writeKeyPair(t, key)
+			ref := address + "/test/image:1"
+
+			if output, err := signImage(ref, imageManifestDigest, private); err != nil {
+				t.Fatalf("signing failed: %v\n%v", err, output)
+			}
+			if output, err := verifyImage(ref, public); err != nil {
+				t.Fatalf("verifying failed: %v\n%v", err, output)
+			}
+		})
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	_, address := startRegistry(t)
+	_, public := writeKeyPair(t, newECDSAKey(t))
+
+	if _, err := verifyImage(address+"/test/image:1", public); err == nil {
+		t.Fatal("an unsigned image verified")
+	}
+}
+
+func TestVerifyWrongKey(t *testing.T) {
+	_, address := startRegistry(t)
+	private, _ := writeKeyPair(t, newECDSAKey(t))
+	_, otherPublic := writeKeyPair(t, newECDSAKey(t))
+	ref := address + "/test/image:1"
+
+	if output, err := signImage(ref, imageManifestDigest, private); err != nil {
+		t.Fatalf("signing failed: %v\n%v", err, output)
+	}
+	if _, err := verifyImage(ref, otherPublic); err == nil {
+		t.Fatal("an image verified with a key that didn't sign it")
+	}
+}
+
+func TestSignKeepsExistingSignatures(t *testing.T) {
+	_, address := startRegistry(t)
+	firstPrivate, firstPublic := writeKeyPair(t, newECDSAKey(t))
+	secondPrivate, secondPublic := writeKeyPair(t, newEd25519Key(t))
+	ref := address + "/test/image:1"
+
+	for _, private := range []string{firstPrivate, secondPrivate} {
+		if output, err := signImage(ref, imageManifestDigest, private); err != nil {
+			t.Fatalf("signing failed: %v\n%v", err, output)
+		}
+	}
+	for _, public := range []string{firstPublic, secondPublic} {
+		if output, err := verifyImage(ref, public); err != nil {
+			t.Fatalf("an earlier signature was lost: %v\n%v", err, output)
+		}
+	}
+}
+
+func TestVerifyOtherRepository(t *testing.T) {
+	registry, address := startRegistry(t)
+	private, public := writeKeyPair(t, newECDSAKey(t))
+
+	if output, err := signImage(address+"/test/image:1", imageManifestDigest, private); err != nil {
+		t.Fatalf("signing failed: %v\n%v", err, output)
+	}
+
+	// Copy the image and its signatures to another repository, which the
+	// signature doesn't name
+	registry.mutex.Lock()
+	for path, manifest := range registry.manifests {
+		if strings.HasPrefix(path, "test/image/") {
+			registry.manifests["test/copy/"+strings.TrimPrefix(path, "test/image/")] = manifest
+		}
+	}
+	registry.mutex.Unlock()
+
+	if _, err := verifyImage(address+"/test/copy:1", public); err == nil {
+		t.Fatal("a signature verified for a repository it wasn't made for")
+	}
+}
+
+func TestPushRepository(t *testing.T) {
+	for _, test := range []struct {
+		ref      string
+		registry string
+		expected string
+	}{
+		{"wblankenship/test:1", "", "registry-1.docker.io/wblankenship/test"},
+		{"test", "", "registry-1.docker.io/library/test"},
+		{"wblankenship/test:1", "registry.example.com", "registry.example.com/wblankenship/test"},
+		{"registry.example.com/wblankenship/test", "", "registry.example.com/wblankenship/test"},
+		{"other.example.com/wblankenship/test:2", "registry.example.com:5000", "registry.example.com:5000/wblankenship/test"},
+	} {
+		if repository := pushRepository(test.ref, test.registry); repository != test.expected {
+			t.Errorf("pushRepository(%q, %q) = %q, expected %q", test.ref, test.registry, repository, test.expected)
+		}
+	}
+}
+
+func TestCredentialHelpers(t *testing.T) {
+	// A credential helper that only knows one server
+	bin := t.TempDir()
+	script := "#!/bin/sh\nread server\nif [ \"$server\" = registry.example.com ]; then\n" +
+		"echo '{\"Username\":\"helped\",\"Secret\":\"s3cret\"}'\nelse\necho 'not found' >&2\nexit 1\nfi\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "docker-credential-fake"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", config)
+	for name, contents := range map[string]string{
+		"credsStore":  `{"credsStore": "fake"}`,
+		"credHelpers": `{"credHelpers": {"registry.example.com": "fake"}, "credsStore": "missing"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(config, "config.json"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		username, password := newRegistryClient("registry.example.com").credentials()
+		if username != "helped" || password != "s3cret" {
+			t.Errorf("%v: expected the helper's credentials, got %q and %q", name, username, password)
+		}
+	}
+
+	// Registries the helper doesn't know fall back to `docker login`
+	auth := base64.StdEncoding.EncodeToString([]byte("stored:password"))
+	contents := `{"credsStore": "fake", "auths": {"other.example.com": {"auth": "` + auth + `"}}}`
+	if err := ioutil.WriteFile(filepath.Join(config, "config.json"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if username, password := newRegistryClient("other.example.com").credentials(); username != "stored" || password != "password" {
+		t.Errorf("expected the stored credentials, got %q and %q", username, password)
+	}
+}
@@ -0,0 +1,338 @@
+/*
+size.go contains the logic for keeping images within the size budgets set in
+the inventory, and for catching images that grow between builds
+*/
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// growthFail fails images that grow by more than max_growth
+	growthFail = "fail"
+	// growthWarn only reports images that grow by more than max_growth
+	growthWarn = "warn"
+)
+
+/*
+sizeUnits are the suffixes accepted for sizes, largest first, with docker's own
+decimal units alongside their binary equivalents
+*/
+var sizeUnits = []struct {
+	Suffix string
+	Bytes  int64
+}{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"GB", 1000 * 1000 * 1000},
+	{"MB", 1000 * 1000},
+	{"kB", 1000},
+	{"KB", 1000},
+	{"B", 1},
+}
+
+/*
+SizeBudget is how large an image from the inventory is allowed to be, and how
+much it is allowed to grow from the image its name pointed at before it was
+built
+*/
+type SizeBudget struct {
+	// MaxSize is the largest the image may be in bytes
+	MaxSize int64
+	// MaxLayers is the most filesystem layers the image may have
+	MaxLayers int
+	// LimitGrowth is whether max_growth was set, since a max_growth of zero
+	// allows no growth at all rather than any amount
+	LimitGrowth bool
+	// GrowthPercent is whether max_growth is MaxGrowthPercent rather than
+	// MaxGrowth
+	GrowthPercent bool
+	// MaxGrowth is the most the image may grow in bytes
+	MaxGrowth int64
+	// MaxGrowthPercent is the most the image may grow as a percentage
+	MaxGrowthPercent float64
+	// GrowthAction is growthFail or growthWarn
+	GrowthAction string
+}
+
+/*
+parseSize reads a size such as `512MB`, `1.5GiB` or a plain number of bytes
+*/
+func parseSize(value interface{}) (size int64, err error) {
+	switch value.(type) {
+	case int:
+		return int64(value.(int)), nil
+	case string:
+		str := strings.TrimSpace(value.(string))
+		multiplier := int64(1)
+		for _, unit := range sizeUnits {
+			if strings.HasSuffix(str, unit.Suffix) {
+				str = strings.TrimSpace(strings.TrimSuffix(str, unit.Suffix))
+				multiplier = unit.Bytes
+				break
+			}
+		}
+		number, parseErr := strconv.ParseFloat(str, 64)
+		if parseErr == nil && number >= 0 {
+			return int64(number * float64(multiplier)), nil
+		}
+	}
+	return 0, fmt.Errorf("`%v` isn't a size like `512MB`", value)
+}
+
+/*
+formatSize prints a number of bytes the way docker does, such as `12.3MB`
+*/
+func formatSize(size int64) string {
+	sign := ""
+	if size < 0 {
+		sign = "-"
+		size = -size
+	}
+	for _, unit := range sizeUnits {
+		// Only docker's decimal units are used for printing
+		if unit.Bytes > 1 && unit.Bytes%1000 == 0 && size >= unit.Bytes {
+			return sign + strconv.FormatFloat(float64(size)/float64(unit.Bytes), 'f', 1, 64) + unit.Suffix
+		}
+	}
+	return sign + strconv.FormatInt(size, 10) + "B"
+}
+
+/*
+getSizeBudget reads the max_size, max_layers, max_growth and growth_action keys
+of image. ok is false if the image doesn't set a budget at all.
+*/
+func getSizeBudget(image map[string]interface{}) (budget SizeBudget, ok bool) {
+	budget.GrowthAction = growthFail
+	if action, isString := image["growth_action"].(string); isString {
+		budget.GrowthAction = action
+	}
+	if value, set := image["max_size"]; set {
+		budget.MaxSize, _ = parseSize(value)
+		ok = true
+	}
+	if value, set := image["max_layers"]; set {
+		budget.MaxLayers, _ = value.(int)
+		ok = true
+	}
+	if value, set := image["max_growth"]; set {
+		// Growth is either a percentage of the previous image or a size
+		if str, isString := value.(string); isString && strings.HasSuffix(str, "%") {
+			budget.MaxGrowthPercent, _ = strconv.ParseFloat(strings.TrimSuffix(str, "%"), 64)
+			budget.GrowthPercent = true
+		} else {
+			budget.MaxGrowth, _ = parseSize(value)
+		}
+		budget.LimitGrowth = true
+		ok = true
+	}
+	return
+}
+
+/*
+verifySizeBudget returns a description of what is wrong with the size budget
+of image, or the empty string if nothing is
+*/
+func verifySizeBudget(image map[string]interface{}) string {
+	if value, ok := image["max_size"]; ok {
+		if _, err := parseSize(value); err != nil {
+			return fmt.Sprintf("max_size %v", err)
+		}
+	}
+	if value, ok := image["max_layers"]; ok {
+		if layers, ok := value.(int); !ok || layers <= 0 {
+			return "max_layers that isn't a positive number"
+		}
+	}
+	if value, ok := image["max_growth"]; ok {
+		str, isString := value.(string)
+		if isString && strings.HasSuffix(str, "%") {
+			if percent, err := strconv.ParseFloat(strings.TrimSuffix(str, "%"), 64); err != nil || percent < 0 {
+				return fmt.Sprintf("max_growth `%v` that isn't a percentage like `10%%`", str)
+			}
+		} else if _, err := parseSize(value); err != nil {
+			return fmt.Sprintf("max_growth %v or a percentage", err)
+		}
+	}
+	if value, ok := image["growth_action"]; ok && value != growthFail && value != growthWarn {
+		return fmt.Sprintf("growth_action `%v` that isn't `%v` or `%v`", value, growthFail, growthWarn)
+	}
+	return ""
+}
+
+/*
+growthExceeded describes how an image that grew from previousSize to size went
+over budget, or returns the empty string if it didn't. A limit of zero allows
+no growth at all.
+*/
+func growthExceeded(budget SizeBudget, previousSize int64, size int64) string {
+	growth := size - previousSize
+	if !budget.LimitGrowth || growth <= 0 {
+		return ""
+	}
+	if !budget.GrowthPercent {
+		if growth > budget.MaxGrowth {
+			return fmt.Sprintf("grew by %v, more than max_growth %v", formatSize(growth), formatSize(budget.MaxGrowth))
+		}
+		return ""
+	}
+	// Any growth from nothing is more than any percentage
+	if previousSize == 0 {
+		return fmt.Sprintf("grew from nothing, more than max_growth %v%%", budget.MaxGrowthPercent)
+	}
+	if percent := float64(growth) * 100 / float64(previousSize); percent > budget.MaxGrowthPercent {
+		return fmt.Sprintf("grew by %.1f%%, more than max_growth %v%%", percent, budget.MaxGrowthPercent)
+	}
+	return ""
+}
+
+/*
+layerDiff renders a table comparing the layers of the previous image with the
+layers of the image just built, lined up oldest first so the layers they share
+line up with each other
+*/
+func layerDiff(before []imageLayer, after []imageLayer) (output string) {
+	output = fmt.Sprintf("| Layer | Instruction | Before | After | Change |\n")
+	output = output + fmt.Sprintf("|-------|-------------|--------|-------|--------|\n")
+
+	count := len(after)
+	if len(before) > count {
+		count = len(before)
+	}
+	for i := 0; i < count; i++ {
+		instruction := ""
+		beforeSize, afterSize := "", ""
+		var change int64
+		if i < len(before) {
+			instruction = before[i].CreatedBy
+			beforeSize = formatSize(before[i].Size)
+			change -= before[i].Size
+		}
+		if i < len(after) {
+			instruction = after[i].CreatedBy
+			afterSize = formatSize(after[i].Size)
+			change += after[i].Size
+		}
+		// Keep the table readable when layers were made by long RUN lines
+		instruction = strings.Replace(instruction, "|", "\\|", -1)
+		if len(instruction) > 60 {
+			instruction = instruction[:57] + "..."
+		}
+		changeStr := formatSize(change)
+		if change > 0 {
+			changeStr = "+" + changeStr
+		}
+		output = output + fmt.Sprintf("| %v | `%v` | %v | %v | %v |\n", i+1, instruction, beforeSize, afterSize, changeStr)
+	}
+	return output + fmt.Sprintf("\n")
+}
+
+/*
+publishedBaseline pulls the image last pushed for image, to measure growth
+against on a host that has never built it. The image is looked up where its
+name, or its first registry, points, and pulled by digest so that its name is
+left pointing at the image just built. It returns the pulled reference.
+*/
+func publishedBaseline(host *dockerHost, image ImageDefinition) (baseline string, err error) {
+	ref := image["name"].(string)
+	if destination := getPushDestinations(image)[0]; destination != "" {
+		ref = registryReference(ref, destination)
+	}
+	registry, repository, reference := resolveReference(ref)
+	digest, err := newRegistryClient(registry).manifestDigest(repository, reference)
+	if err != nil {
+		return
+	}
+
+	// Pin the reference, as written, to the digest the registry has now
+	named, bare, _ := splitReference(ref)
+	if i := strings.Index(bare, "@"); i != -1 {
+		bare = bare[:i]
+	}
+	baseline = bare + "@" + digest
+	if named != "" {
+		baseline = named + "/" + baseline
+	}
+	output, err := pullImage(host, baseline)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", err, strings.TrimSpace(output))
+	}
+	return
+}
+
+/*
+checkImageSize compares the image just built for image against its size
+budget, and against previous, the id of the image its name pointed at before it
+was built. previous is empty if there was no such image, in which case the
+image last pushed for it is used instead, if there is one.
+*/
+func checkImageSize(host *dockerHost, image ImageDefinition, previous string) (output string, err error) {
+	budget, ok := getSizeBudget(image)
+	if !ok {
+		return
+	}
+	name := image["name"].(string)
+	output = fmt.Sprintf("## Size\n\n")
+	fail := func(format string, args ...interface{}) {
+		err = fmt.Errorf(format, args...)
+		output = output + fmt.Sprintf("**Failed** with error: `%v`\n\n", err)
+	}
+
+	size, layers, inspectErr := imageSize(host, name)
+	if inspectErr != nil {
+		fail("%v", inspectErr)
+		return
+	}
+	output = output + fmt.Sprintf("`%v` is %v in %v layers\n\n", name, formatSize(size), layers)
+
+	if budget.MaxSize > 0 && size > budget.MaxSize {
+		fail("%v is larger than max_size %v", formatSize(size), formatSize(budget.MaxSize))
+	}
+	if budget.MaxLayers > 0 && layers > budget.MaxLayers {
+		fail("%v layers is more than max_layers %v", layers, budget.MaxLayers)
+	}
+
+	// A host that never built the image, like a fresh CI runner, compares
+	// against what was last pushed instead
+	if previous == "" && budget.LimitGrowth {
+		baseline, baselineErr := publishedBaseline(host, image)
+		if baselineErr != nil {
+			output = output + fmt.Sprintf("No previous image to measure growth against, and none could be pulled: `%v`\n\n", baselineErr)
+			return
+		}
+		previous = baseline
+	}
+
+	// Without a previous image there is nothing to have grown from
+	current, _ := imageId(host, name)
+	if previous == "" || previous == current {
+		return
+	}
+	previousSize, _, inspectErr := imageSize(host, previous)
+	if inspectErr != nil {
+		output = output + fmt.Sprintf("Could not inspect the previous image `%v`: `%v`\n\n", previous, inspectErr)
+		return
+	}
+	output = output + fmt.Sprintf("Compared to the previous image `%v` (%v)\n\n", previous, formatSize(previousSize))
+
+	beforeLayers, beforeErr := imageHistory(host, previous)
+	afterLayers, afterErr := imageHistory(host, name)
+	if beforeErr == nil && afterErr == nil {
+		output = output + layerDiff(beforeLayers, afterLayers)
+	}
+
+	exceeded := growthExceeded(budget, previousSize, size)
+	if exceeded == "" {
+		return
+	}
+	if budget.GrowthAction == growthWarn {
+		output = output + fmt.Sprintf("**Warning**: `%v` %v\n\n", name, exceeded)
+		return
+	}
+	fail("%v", exceeded)
+	return
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected int64
+		valid    bool
+	}{
+		{1024, 1024, true},
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"250MB", 250 * 1000 * 1000, true},
+		{"1.5GiB", 3 << 29, true},
+		{"10 KiB", 10 << 10, true},
+		{"2kB", 2000, true},
+		{"0", 0, true},
+		{"-1MB", 0, false},
+		{"large", 0, false},
+		{"MB", 0, false},
+		{1.5, 0, false},
+		{nil, 0, false},
+	} {
+		size, err := parseSize(test.value)
+		if (err == nil) != test.valid || size != test.expected {
+			t.Errorf("parseSize(%#v) = %v, %v; expected %v, valid %v", test.value, size, err, test.expected, test.valid)
+		}
+	}
+}
+
+func TestVerifySizeBudget(t *testing.T) {
+	for _, test := range []struct {
+		image    map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{}, ""},
+		{map[string]interface{}{"max_size": "250MB", "max_layers": 10, "max_growth": "10%", "growth_action": "warn"}, ""},
+		{map[string]interface{}{"max_growth": 0}, ""},
+		{map[string]interface{}{"max_growth": "0%"}, ""},
+		{map[string]interface{}{"max_growth": "5MB"}, ""},
+		{map[string]interface{}{"max_size": "huge"}, "max_size `huge` isn't a size like `512MB`"},
+		{map[string]interface{}{"max_layers": 0}, "max_layers that isn't a positive number"},
+		{map[string]interface{}{"max_layers": "10"}, "max_layers that isn't a positive number"},
+		{map[string]interface{}{"max_growth": "-5%"}, "max_growth `-5%` that isn't a percentage like `10%`"},
+		{map[string]interface{}{"max_growth": "lots"}, "max_growth `lots` isn't a size like `512MB` or a percentage"},
+		{map[string]interface{}{"growth_action": "ignore"}, "growth_action `ignore` that isn't `fail` or `warn`"},
+	} {
+		if problem := verifySizeBudget(test.image); problem != test.expected {
+			t.Errorf("verifySizeBudget(%v) = %q, expected %q", test.image, problem, test.expected)
+		}
+	}
+}
+
+func TestGrowthExceeded(t *testing.T) {
+	for _, test := range []struct {
+		growth   interface{}
+		previous int64
+		size     int64
+		exceeded bool
+	}{
+		{0, 100, 100, false},
+		{0, 100, 101, true},
+		{0, 100, 50, false},
+		{"0%", 100, 101, true},
+		{"10", 100, 110, false},
+		{"10", 100, 111, true},
+		{"10%", 100, 110, false},
+		{"10%", 100, 111, true},
+		{"10%", 0, 1, true},
+	} {
+		budget, _ := getSizeBudget(map[string]interface{}{"max_growth": test.growth})
+		if exceeded := growthExceeded(budget, test.previous, test.size); (exceeded != "") != test.exceeded {
+			t.Errorf("growing from %v to %v with max_growth %v: %q, expected exceeded %v", test.previous, test.size, test.growth, exceeded, test.exceeded)
+		}
+	}
+	if exceeded := growthExceeded(SizeBudget{}, 100, 1000); exceeded != "" {
+		t.Errorf("an image without max_growth exceeded it: %q", exceeded)
+	}
+}
+
+/*
+sizeDocker is a docker where every image is 200 bytes, except for images pulled
+by digest, which are 100, and which logs every image it pulls
+*/
+const sizeDocker = `#!/bin/sh
+eval "name=\${$#}"
+case "$1" in
+pull)
+	echo "$name" >> "$PULLED"
+	;;
+inspect)
+	case "$5" in
+	*Size*)
+		case "$name" in
+		*@sha256:*) echo 100 1 ;;
+		*) echo 200 2 ;;
+		esac
+		;;
+	*) echo "sha256:$name" ;;
+	esac
+	;;
+esac
+`
+
+func TestCheckImageSizePublishedBaseline(t *testing.T) {
+	_, address := startRegistry(t)
+	bin := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(bin, "docker"), []byte(sizeDocker), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pulled := filepath.Join(bin, "pulled")
+	t.Setenv("PATH", bin+":/bin:/usr/bin")
+	t.Setenv("PULLED", pulled)
+
+	image := ImageDefinition{"name": address + "/test/image:1", "max_growth": "10%"}
+	output, err := checkImageSize(localHost, image, "")
+	if err == nil {
+		t.Errorf("expected doubling in size from the pushed image to fail, got:\n%v", output)
+	}
+	contents, _ := ioutil.ReadFile(pulled)
+	if expected := address + "/test/image@" + imageManifestDigest; strings.TrimSpace(string(contents)) != expected {
+		t.Errorf("expected `%v` to be pulled, got %q", expected, contents)
+	}
+
+	// Nothing pushed yet leaves nothing to grow from
+	image = ImageDefinition{"name": address + "/test/new:1", "max_growth": "10%"}
+	if output, err := checkImageSize(localHost, image, ""); err != nil {
+		t.Errorf("expected an image never pushed to pass, got:\n%v", output)
+	}
+}
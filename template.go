@@ -0,0 +1,286 @@
+/*
+template.go contains the logic for expanding templates found in the values of
+an inventory.yml file
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+templateData holds the variables available to templates in inventory.yml, for
+example `{{.Name}}-{{.GitSHA}}` or `{{.Env.USER}}/node:{{.Vars.version}}`
+*/
+type templateData struct {
+	// Name of the image the template belongs to, available to `alias` and `path`
+	Name string
+	// GitSHA is the commit checked out where the image's inventory file is
+	GitSHA string
+	// GitShortSHA is the abbreviated form of GitSHA
+	GitShortSHA string
+	// GitBranch is the branch checked out where the image's inventory file
+	// is, see gitBranch
+	GitBranch string
+	// GitTag is the tag pointing at the checked out commit, if there is one
+	GitTag string
+	// Date is the day dante was run, formatted as 2006-01-02
+	Date string
+	// Timestamp is the time dante was run, formatted as 20060102150405
+	Timestamp string
+	// Env holds the environment variables dante was run with
+	Env map[string]string
+	// Vars holds the custom variables from the inventory's `vars` key
+	Vars map[string]string
+	// Matrix holds the matrix cell the image was expanded from, if any
+	Matrix map[string]string
+}
+
+/*
+gitOutput runs git with args in dir, or in the current working directory if dir
+is empty, and returns its trimmed stdout. If git fails (not installed, not a
+repository, ...) it returns the empty string, since a template referencing git
+information is only an error if it is actually used.
+*/
+func gitOutput(dir string, args ...string) string {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	output, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+/*
+branchVariables are the environment variables CI systems name the branch being
+built in, since they usually check out the commit itself rather than a branch
+*/
+var branchVariables = []string{
+	"GITHUB_HEAD_REF",
+	"CI_COMMIT_REF_NAME",
+	"CIRCLE_BRANCH",
+	"BUILDKITE_BRANCH",
+	"TRAVIS_BRANCH",
+	"BRANCH_NAME",
+}
+
+/*
+gitBranch returns the branch checked out in dir. With a detached HEAD there is
+no branch checked out, so the branch CI says it is building is used, or the
+empty string if it doesn't say.
+*/
+func gitBranch(dir string) string {
+	if branch := gitOutput(dir, "symbolic-ref", "--quiet", "--short", "HEAD"); branch != "" {
+		return branch
+	}
+	for _, variable := range branchVariables {
+		if branch := os.Getenv(variable); branch != "" {
+			return branch
+		}
+	}
+	// GitHub only names the branch of a push in GITHUB_REF_NAME, which holds
+	// the tag instead when a tag was pushed
+	if os.Getenv("GITHUB_REF_TYPE") == "branch" {
+		return os.Getenv("GITHUB_REF_NAME")
+	}
+	return ""
+}
+
+/*
+sourceDir returns the directory of the inventory file image was defined in, or
+the empty string for images that don't record one
+*/
+func sourceDir(image map[string]interface{}) string {
+	if source, ok := image["source"].(string); ok {
+		return filepath.Dir(source)
+	}
+	return ""
+}
+
+/*
+newTemplateData gathers the variables available to every template of images
+defined in an inventory file in dir
+*/
+func newTemplateData(vars map[string]string, dir string) templateData {
+	now := time.Now().UTC()
+
+	env := make(map[string]string)
+	for _, pair := range os.Environ() {
+		if i := strings.Index(pair, "="); i != -1 {
+			env[pair[:i]] = pair[i+1:]
+		}
+	}
+
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+
+	return templateData{
+		GitSHA:      gitOutput(dir, "rev-parse", "HEAD"),
+		GitShortSHA: gitOutput(dir, "rev-parse", "--short", "HEAD"),
+		GitBranch:   gitBranch(dir),
+		GitTag:      gitOutput(dir, "describe", "--tags", "--exact-match"),
+		Date:        now.Format("2006-01-02"),
+		Timestamp:   now.Format("20060102150405"),
+		Env:         env,
+		Vars:        vars,
+	}
+}
+
+/*
+renderTemplate expands text as a go template using data. Referencing a variable
+that doesn't exist is an error rather than silently producing an empty string.
+*/
+func renderTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("inventory").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+/*
+resolveTemplates expands the templates in every image's name, path, aliases and
+matrix group so that the rest of the application only ever sees literal
+strings. The name is resolved first so that `path` and `alias` can refer to it
+as `{{.Name}}`.
+*/
+func resolveTemplates(images []map[string]interface{}, vars map[string]string) (err error) {
+	// Every image from the same file shares its variables
+	shared := make(map[string]templateData)
+	for _, image := range images {
+		dir := sourceDir(image)
+		if _, ok := shared[dir]; !ok {
+			shared[dir] = newTemplateData(vars, dir)
+		}
+		// Each image starts from the shared variables, so nothing it sets, such
+		// as its name, carries over to the next image
+		data := shared[dir]
+		data.Matrix = getMatrixCell(image)
+		for _, key := range []string{"name", "path"} {
+			value, ok := image[key].(string)
+			if !ok {
+				continue
+			}
+			image[key], err = renderTemplate(value, data)
+			if err != nil {
+				return fmt.Errorf("could not resolve %v `%v`: %v", key, value, err)
+			}
+			if key == "name" {
+				data.Name = image[key].(string)
+			}
+		}
+
+		// The group an image was expanded from is rendered with the same data
+		// as its name, but with each matrix value standing in as `<KEY>`, so
+		// every cell of the group renders to the same heading
+		if group, ok := image["matrix_group"].(string); ok {
+			groupData := data
+			groupData.Matrix = make(map[string]string)
+			for key := range data.Matrix {
+				groupData.Matrix[key] = "<" + key + ">"
+			}
+			image["matrix_group"], err = renderTemplate(group, groupData)
+			if err != nil {
+				return fmt.Errorf("could not resolve name `%v`: %v", group, err)
+			}
+		}
+
+		aliases := []interface{}{}
+		for _, alias := range getAliasArray(image) {
+			var rendered string
+			rendered, err = renderTemplate(alias, data)
+			if err != nil {
+				return fmt.Errorf("could not resolve alias `%v`: %v", alias, err)
+			}
+			aliases = append(aliases, rendered)
+		}
+
+		// Expand semantic versions into their shorter forms
+		if semver, _ := image["semver"].(bool); semver {
+			for _, alias := range semverAliases(data.Name) {
+				if !containsString(aliases, alias) {
+					aliases = append(aliases, alias)
+				}
+			}
+		}
+
+		if len(aliases) > 0 {
+			image["alias"] = aliases
+		}
+	}
+	return
+}
+
+/*
+semverPattern matches a MAJOR.MINOR.PATCH version, optionally prefixed with v
+*/
+var semverPattern = regexp.MustCompile(`^(v?)(\d+)\.(\d+)\.(\d+)$`)
+
+/*
+semverAliases takes an image name whose tag is a semantic version such as
+`node:1.2.3` and returns the aliases that version should also be published as:
+`node:1.2`, `node:1` and `node:latest`. Names whose tag isn't a plain release
+version (including pre-releases like `1.2.3-rc1`) have no aliases.
+*/
+func semverAliases(name string) (aliases []string) {
+	registry, repository, tag := splitReference(name)
+	match := semverPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return
+	}
+
+	prefix := repository
+	if registry != "" {
+		prefix = registry + "/" + repository
+	}
+
+	return []string{
+		prefix + ":" + match[1] + match[2] + "." + match[3],
+		prefix + ":" + match[1] + match[2],
+		prefix + ":latest",
+	}
+}
+
+/*
+containsString returns true if list contains str
+*/
+func containsString(list []interface{}, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+reportInventory prints the inventory as resolved from its templates, so the
+report records exactly which names, paths and aliases dante worked with.
+*/
+func reportInventory(inventory Inventory) {
+	fmt.Printf("# Inventory\n\n| Image | Path | Aliases |\n|---|---|---|\n")
+	for _, image := range inventory["images"] {
+		aliases := []string{}
+		for _, alias := range getAliasArray(image) {
+			aliases = append(aliases, "`"+alias+"`")
+		}
+		fmt.Printf("| `%v` | `%v` | %v |\n", image["name"], image["path"], strings.Join(aliases, ", "))
+	}
+	fmt.Printf("\n")
+}
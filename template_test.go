@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/*
+gitRepository makes a git repository in a temporary directory with a single
+commit on the branch `feature`, and returns its directory
+*/
+func gitRepository(t *testing.T) string {
+	dir := t.TempDir()
+	writeFile(t, dir, "inventory.yml", "images: []\n")
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"checkout", "--quiet", "-b", "feature"},
+		{"add", "inventory.yml"},
+		{"-c", "user.name=dante", "-c", "user.email=dante@example.com", "commit", "--quiet", "-m", "inventory"},
+	} {
+		if output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Skipf("git %v: %v: %s", args, err, output)
+		}
+	}
+	return dir
+}
+
+/*
+clearBranchVariables unsets every variable gitBranch reads, so the CI running
+the tests doesn't decide them
+*/
+func clearBranchVariables(t *testing.T) {
+	for _, variable := range append(branchVariables, "GITHUB_REF_TYPE", "GITHUB_REF_NAME") {
+		t.Setenv(variable, "")
+	}
+}
+
+func TestGitBranch(t *testing.T) {
+	clearBranchVariables(t)
+	dir := gitRepository(t)
+	if branch := gitBranch(dir); branch != "feature" {
+		t.Errorf("expected branch `feature`, got %q", branch)
+	}
+
+	// A detached HEAD has no branch, unless CI names one
+	exec.Command("git", "-C", dir, "checkout", "--quiet", "--detach").Run()
+	if branch := gitBranch(dir); branch != "" {
+		t.Errorf("expected no branch for a detached HEAD, got %q", branch)
+	}
+	t.Setenv("GITHUB_REF_TYPE", "tag")
+	t.Setenv("GITHUB_REF_NAME", "v1.0.0")
+	if branch := gitBranch(dir); branch != "" {
+		t.Errorf("expected a tag push to have no branch, got %q", branch)
+	}
+	t.Setenv("GITHUB_REF_TYPE", "branch")
+	t.Setenv("GITHUB_REF_NAME", "main")
+	if branch := gitBranch(dir); branch != "main" {
+		t.Errorf("expected the branch GitHub pushed, got %q", branch)
+	}
+	t.Setenv("CI_COMMIT_REF_NAME", "release")
+	if branch := gitBranch(dir); branch != "release" {
+		t.Errorf("expected the branch GitLab is building, got %q", branch)
+	}
+}
+
+func TestResolveTemplatesReadsGitWhereTheInventoryIs(t *testing.T) {
+	clearBranchVariables(t)
+	dir := gitRepository(t)
+	sha := gitOutput(dir, "rev-parse", "HEAD")
+
+	images := []map[string]interface{}{{
+		"name":   "app:{{.GitBranch}}-{{.Vars.version}}",
+		"path":   "{{.Name}}",
+		"alias":  stringsToInterfaces([]string{"app:{{.GitSHA}}"}),
+		"source": filepath.Join(dir, "inventory.yml"),
+	}}
+	if err := resolveTemplates(images, map[string]string{"version": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"name":   "app:feature-1",
+		"path":   "app:feature-1",
+		"alias":  stringsToInterfaces([]string{"app:" + sha}),
+		"source": filepath.Join(dir, "inventory.yml"),
+	}
+	if !reflect.DeepEqual(images[0], expected) {
+		t.Errorf("expected %v, got %v", expected, images[0])
+	}
+
+	missing := []map[string]interface{}{{"name": "app:{{.Vars.missing}}"}}
+	if err := resolveTemplates(missing, nil); err == nil {
+		t.Error("expected a missing variable to be an error")
+	}
+}
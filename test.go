@@ -5,11 +5,14 @@ test.go contains all of the logic specific to the test command
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 )
 
 /*
@@ -25,148 +28,568 @@ const tempPath = ".~tmp.test"
 
 var errs []error
 
+/*
+TestDefinition is a single Dockerfile test from an image's test key
+*/
+type TestDefinition struct {
+	// Path is the directory holding the test's Dockerfile
+	Path string
+	// Quarantine reports the test's failures without failing the image
+	Quarantine bool
+}
+
+/*
+getTests returns the Dockerfile tests of a single image from the inventory.yml
+file. A test is either a path, or a map like
+`{path: ./tests/http, quarantine: true}`. Tests of other kinds, such as scans,
+are left out; see getScanTests.
+*/
+func getTests(image map[string]interface{}) (tests []TestDefinition) {
+	for _, entry := range getTestEntries(image) {
+		if path, ok := entry.(string); ok {
+			tests = append(tests, TestDefinition{Path: path})
+			continue
+		}
+		fields, ok := yamlMap(entry)
+		if !ok {
+			continue
+		}
+		if _, ok := fields["kind"]; ok {
+			continue
+		}
+		if path, ok := fields["path"].(string); ok {
+			quarantine, _ := fields["quarantine"].(bool)
+			tests = append(tests, TestDefinition{Path: path, Quarantine: quarantine})
+		}
+	}
+	return
+}
+
 /*
 getTestArray takes a single image from the inventory.yml file and converts
 its test key (of type interface{}) to an array of strings. This allows us
 to accept either a single string or an array of strings as a value for
-test.
+test, along with tests written as maps.
 */
 func getTestArray(image map[string]interface{}) (tests []string) {
-	switch image["test"].(type) {
-	case string:
-		// If the value is a single string, append it to the array and be done
-		tests = append(tests, image["test"].(string))
-		break
-	case []interface{}:
-		// If the value is an array, iterate through and add all of the strings
-		// to the array one by one.
-		for _, str := range image["test"].([]interface{}) {
-			tests = append(tests, str.(string))
-		}
-		break
+	for _, test := range getTests(image) {
+		tests = append(tests, test.Path)
 	}
 	return
 }
 
 type TestOpts struct {
-	Threads int
-	Retries int
+	Threads    int
+	Retries    int
+	PushPolicy string
+	Attest     string
+	SignKey    string
+	Diff       bool
+	// FailFast cancels the remaining jobs as soon as one fails
+	FailFast bool
+	// FlakyHistory is the file the results of tests are recorded in across
+	// runs. Empty means no history is kept.
+	FlakyHistory string
+	// Inventory is the inventory file the images came from, which tests are
+	// recorded relative to in FlakyHistory
+	Inventory string
+	// MaxBuilds, MaxTests and MaxPushes cap how many of each run at once,
+	// zero leaves it to the host's resources
+	MaxBuilds int
+	MaxTests  int
+	MaxPushes int
+	// Remote holds the URLs of agents to run jobs on, instead of the docker
+	// hosts in the inventory
+	Remote []string
+	// RemoteToken is sent to the agents in Remote to authenticate
+	RemoteToken string
+	// Hosts and Schedulers, if they are set, are the hosts to run on and their
+	// schedulers from testSchedulers, so that watch doesn't ask every host
+	// for its capacity on every run
+	Hosts      []*dockerHost
+	Schedulers map[*dockerHost]*scheduler
+	// Only, if it is set, limits the run to the images with these names
+	Only map[string]bool
+	// Quiet leaves reporting to the caller, which only gets the results
+	Quiet bool
+}
+
+/*
+testSchedulers returns the hosts the images in inventory are tested on, either
+its docker hosts or the agents in opts.Remote, along with their schedulers
+*/
+func testSchedulers(inventory Inventory, opts TestOpts) (hosts []*dockerHost, scheds map[*dockerHost]*scheduler) {
+	hosts = getHosts(inventory)
+	if len(opts.Remote) > 0 {
+		hosts = remoteHosts(opts.Remote, opts.RemoteToken)
+	}
+	scheds = newHostSchedulers(hosts, map[string]int{
+		stepBuild: opts.MaxBuilds,
+		stepTest:  opts.MaxTests,
+	})
+	return
 }
 
 /*
 runTests iterates through an Inventory object and builds every image, followed
 by running each of the tests listed against the newly built image. We attempt
-to build every image defined in inventory, and return an array of errors if any
-are encountered.
+to build every image defined in inventory (or in opts.Only), and return the
+number of images that didn't pass, how many jobs finished with each status, and
+the finished job of each image by its index in inventory. With opts.FailFast the
+first failure cancels everything still running or queued.
 */
-func runTests(inventory Inventory, opts TestOpts) (errs int) {
+func runTests(inventory Inventory, opts TestOpts) (errs int, statuses map[string]int, results map[int]Job) {
+
+	// Images left out of the run still count when deciding hosts and
+	// priorities, so the images that do run are treated the same either way
+	selected := []int{}
+	for i, image := range inventory["images"] {
+		if opts.Only == nil || opts.Only[image["name"].(string)] {
+			selected = append(selected, i)
+		}
+	}
 
 	input := make(chan Job)
 	output := make(chan Job)
-	done := make(chan bool, len(inventory["images"]))
+	done := make(chan Job, len(selected))
 
-	for i := 0; i < opts.Threads; i++ {
-		go testWorker(input, output)
+	// Every image is built and tested on the host it is assigned to, which
+	// has a scheduler of its own
+	hosts, scheds := opts.Hosts, opts.Schedulers
+	if hosts == nil {
+		hosts, scheds = testSchedulers(inventory, opts)
+	}
+	assigned := assignHosts(inventory, hosts)
+	if !opts.Quiet {
+		reportHosts(inventory, hosts, assigned)
+		reportSchedulers(hosts, scheds)
 	}
 
-	go reporter(output, done)
+	for i := 0; i < workerCount(opts, len(selected)); i++ {
+		go testWorker(input, output, scheds)
+	}
 
-	for i, image := range inventory["images"] {
-		input <- Job{
+	// On a terminal every job is followed live, and the output of each is
+	// printed once the run is over rather than as it finishes
+	var ui *tui
+	if !opts.Quiet && useTUI() {
+		ui = newTUI()
+	}
+
+	go reporter(output, done, opts.Quiet || ui != nil)
+
+	// An image built FROM another image in the run waits for it to build, and
+	// fails without building if it doesn't
+	run := make(map[string]bool)
+	for _, i := range selected {
+		run[inventory["images"][i]["name"].(string)] = true
+	}
+	order := newBuildOrder(buildParents(inventory, run), func(job Job) {
+		input <- job
+	}, func(job Job, parent string) {
+		if skipped, ok := skipJob(job); ok {
+			output <- skipped
+			return
+		}
+		job.Success = false
+		job.Output = fmt.Sprintf("# Tested image `%v`\n\nNot built since `%v`, the image it is built FROM, failed to build\n\n", job.Image["name"], parent)
+		output <- finishJob(job)
+	})
+
+	priorities := getPriorities(inventory)
+	jobs := []Job{}
+	for _, i := range priorityOrder(inventory, priorities) {
+		image := inventory["images"][i]
+		if opts.Only != nil && !opts.Only[image["name"].(string)] {
+			continue
+		}
+		job := Job{
 			Image:   image,
 			Retries: opts.Retries,
-			Id:      i,
+			// Tracking flaky tests is asking for their failures to be
+			// retried, or they would never get a chance to pass
+			RetryTests: opts.FlakyHistory != "",
+			Id:         i,
+			Attest:     opts.Attest,
+			Diff:       opts.Diff,
+			Priority:   priorities[image["name"].(string)],
+			Host:       assigned[image["name"].(string)],
+		}
+		if ui != nil {
+			job.Log, job.State = ui.add(image["name"].(string))
 		}
+		name := image["name"].(string)
+		job.Built = func(success bool) {
+			order.finished(name, success)
+		}
+		jobs = append(jobs, job)
+	}
+	if ui != nil {
+		ui.start()
 	}
 
+	// Queue the jobs in the background so failures are seen as they happen,
+	// not once every job has been handed to a worker
+	go func() {
+		for _, job := range jobs {
+			order.add(job)
+		}
+	}()
+
 	errs = 0
-	for i := 0; i < len(inventory["images"]); i++ {
-		if <-done == false {
+	statuses = make(map[string]int)
+	results = make(map[int]Job)
+	finished := []Job{}
+	for range selected {
+		job := <-done
+		job.setState(job.Status)
+		// Jobs that never got as far as building still release the images
+		// waiting on them
+		order.finished(job.Image["name"].(string), job.Success)
+		finished = append(finished, job)
+		results[job.Id] = job
+		statuses[job.Status]++
+		if !job.Success {
 			errs++
+			if opts.FailFast {
+				cancelJobs()
+			}
+		}
+	}
+	// Every image is done, tests included, so nothing is left to queue and the
+	// workers and reporter can stop. Watch runs again and again, and would
+	// otherwise leave them behind every time.
+	close(input)
+	close(output)
+
+	if opts.Quiet {
+		return
+	}
+	if ui != nil {
+		ui.stop()
+		for _, job := range finished {
+			fmt.Printf("%v", job.Output)
 		}
 	}
+	reportMatrices(inventory, results)
+
+	tests := []TestResult{}
+	for _, i := range selected {
+		tests = append(tests, results[i].Tests...)
+	}
+	root := ""
+	if opts.Inventory != "" {
+		if abs, err := filepath.Abs(opts.Inventory); err == nil {
+			root = filepath.Dir(abs)
+		}
+	}
+	var history FlakyHistory
+	if opts.FlakyHistory != "" {
+		var err error
+		history, err = loadFlakyHistory(opts.FlakyHistory)
+		if err == nil {
+			recordTests(history, tests, root)
+			err = saveFlakyHistory(opts.FlakyHistory, history)
+		}
+		if err != nil {
+			fmt.Printf("**Failed** to update flaky test history: `%v`\n\n", err)
+		}
+	}
+	reportFlaky(tests, history, root)
 
 	return
 }
 
-func testWorker(input chan Job, output chan Job) {
-	for {
-		tmp := <-input
+/*
+imageRun is an image part way through being tested, waiting on the results of
+its tests, which run as their own jobs
+*/
+type imageRun struct {
+	mutex sync.Mutex
+	job   Job
+	// stdout is the image's output from before its tests ran
+	stdout   string
+	lintErr  error
+	started  time.Time
+	finished time.Time
+	// remaining counts the tests that haven't finished yet
+	remaining int
+	// testOutputs holds the output of each test, in test order
+	testOutputs []string
+	// testResults holds the result of each test, in test order
+	testResults []TestResult
+}
+
+/*
+testFinished records the result of the test at index testNum of run, and
+returns true once it was the last of run's tests to finish. cancelled is set
+when --fail-fast stopped the test.
+*/
+func (run *imageRun) testFinished(testNum int, output string, result TestResult, failsImage bool, cancelled bool) bool {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.testOutputs[testNum] = output
+	run.testResults[testNum] = result
+	if failsImage {
+		run.job.Success = false
+	}
+	if cancelled {
+		run.job.Cancelled = true
+	}
+	run.remaining--
+	return run.remaining == 0
+}
+
+func testWorker(input chan Job, output chan Job, scheds map[*dockerHost]*scheduler) {
+	for tmp := range input {
+		sched := scheds[tmp.Host]
+
+		// Tests run as jobs of their own once their image has built, and the
+		// last of an image's tests to finish completes the image
+		if tmp.Run != nil {
+			if testJob(tmp, sched) {
+				output <- completeImage(tmp.Run)
+			}
+			continue
+		}
+
+		if skipped, ok := skipJob(tmp); ok {
+			output <- skipped
+			continue
+		}
+
+		// Agents run the whole job themselves
+		if tmp.Host.Agent != "" {
+			output <- runRemote(tmp)
+			continue
+		}
 		var resultString string
 
 		// Initialize Output For Image
-		stdout := fmt.Sprintf("# Tested image `%v`\n\n## Build Log\n\n", tmp.Image["name"].(string))
+		stdout := fmt.Sprintf("# Tested image `%v`\n\n", tmp.Image["name"].(string))
+		if tmp.Host != localHost {
+			stdout = stdout + fmt.Sprintf("Running on host `%v`\n\n", tmp.Host.Name)
+		}
+
+		// Lint problems fail the image, but only stop it from being built when
+		// the image asks for that
+		resultString, lintErr := testLint(tmp.Image)
+		stdout = stdout + resultString
+		if lintErr != nil && getLintOpts(tmp.Image).Block {
+			stdout = stdout + fmt.Sprintf("Not building `%v` until its lint problems are fixed\n\n", tmp.Image["name"].(string))
+			tmp.Success = false
+			tmp.Output = stdout
+			output <- finishJob(tmp)
+			continue
+		}
+
+		// Remember what the image's name pointed at before this build, so the
+		// new image can be checked for growth and diffed against it
+		var previous string
+		if _, ok := getSizeBudget(tmp.Image); ok || tmp.Diff {
+			previous, _ = imageId(tmp.Host, tmp.Image["name"].(string))
+		}
 
+		stdout = stdout + fmt.Sprintf("## Build Log\n\n")
+		started := time.Now()
+		demand := getResources(tmp.Image)
+		sched.acquire(stepBuild, demand, tmp.Priority)
 		resultString, tmp = testBuildImage(tmp)
+		sched.release(stepBuild, demand)
+		tmp.built(tmp.Success)
 		stdout = stdout + resultString
+		finished := time.Now()
 
 		// If we did not successfully build, there is nothing left to do
 		if !tmp.Success {
 			tmp.Output = stdout
-			output <- tmp
+			output <- finishJob(tmp)
 			continue
 		}
 
-		resultString, tmp = testBuildTests(tmp)
+		resultString, err := checkImageSize(tmp.Host, tmp.Image, previous)
 		stdout = stdout + resultString
+		if err != nil {
+			tmp.Success = false
+		}
+
+		if tmp.Diff {
+			stdout = stdout + testDiff(tmp.Host, tmp.Image, previous)
+		}
+
+		sched.acquire(stepTest, demand, tmp.Priority)
+		tmp.setState(stateTesting)
+		resultString, tmp = testScans(tmp)
+		sched.release(stepTest, demand)
+		stdout = stdout + resultString
+		if lintErr != nil {
+			tmp.Success = false
+		}
 
-		tmp.Output = stdout
-		output <- tmp
+		tests := getTests(tmp.Image)
+		stdout = stdout + fmt.Sprintf("Array of tests: `%v`\n\n", getTestArray(tmp.Image))
+		run := &imageRun{
+			job:         tmp,
+			stdout:      stdout,
+			started:     started,
+			finished:    finished,
+			remaining:   len(tests),
+			testOutputs: make([]string, len(tests)),
+			testResults: make([]TestResult, len(tests)),
+		}
+		if len(tests) == 0 {
+			output <- completeImage(run)
+			continue
+		}
+
+		// Hand each test to the pool. Queueing from a goroutine keeps this
+		// worker free, so tests can't be stuck waiting on busy workers.
+		for testNum, test := range tests {
+			go func(job Job) {
+				input <- job
+			}(Job{
+				Image:      tmp.Image,
+				Retries:    tmp.Retries,
+				RetryTests: tmp.RetryTests,
+				Id:         tmp.Id,
+				Priority:   tmp.Priority,
+				Host:       tmp.Host,
+				Log:        tmp.Log,
+				State:      tmp.State,
+				Run:        run,
+				TestNum:    testNum,
+				Test:       test,
+			})
+		}
 	}
 }
 
-func testBuildImage(tmp Job) (string, Job) {
+/*
+testJob runs a single test job, recording its result with the image it belongs
+to. It returns true if it was the last of that image's tests to finish.
+*/
+func testJob(job Job, sched *scheduler) bool {
+	var output string
+	var attempts int
+	var err error
+	if _, skipped := skipJob(job); skipped {
+		output = fmt.Sprintf("## Running test #%v\n\nNot started since an earlier job failed with --fail-fast\n\n", job.TestNum)
+		err = errCancelled
+	} else {
+		demand := getResources(job.Image)
+		sched.acquire(stepTest, demand, job.Priority)
+		output, attempts, err = testBuildTest(job)
+		sched.release(stepTest, demand)
+	}
 
-	var stdout string
+	result := TestResult{
+		Image:      job.Image["name"].(string),
+		Test:       job.Test.Path,
+		Attempts:   attempts,
+		Quarantine: job.Test.Quarantine,
+		Status:     testPassed,
+	}
+	if err != nil {
+		result.Status = testFailed
+	} else if attempts > 1 {
+		// Passing only after a retry is worth knowing about even though
+		// the image passed
+		result.Status = testFlaky
+		output = output + fmt.Sprintf("**Flaky**: test #%v only passed after %v attempts\n\n", job.TestNum, attempts)
+	}
+	if err != nil && job.Test.Quarantine {
+		output = output + fmt.Sprintf("Test #%v is quarantined, so its failure doesn't fail the image\n\n", job.TestNum)
+	}
+	return job.Run.testFinished(job.TestNum, output, result, err != nil && !job.Test.Quarantine, errors.Is(err, errCancelled))
+}
 
-	// Attempt to build the image until we run out of retries
-	for retries := tmp.Retries; retries >= 0; retries-- {
-		// Try to build the image
-		result, err := buildImage(tmp.Image["name"].(string), tmp.Image["path"].(string), DockerOpts{})
-		stdout = stdout + fmt.Sprintf("```\n%v\n```\n\n", string(result))
+/*
+completeImage finishes an image once all of its tests are done, recording its
+attestations and tagging its aliases if everything passed
+*/
+func completeImage(run *imageRun) Job {
+	tmp := run.job
+	tmp.Tests = run.testResults
+	stdout := run.stdout
+	for _, output := range run.testOutputs {
+		stdout = stdout + output
+	}
 
-		// If we fail, determine proper notice to log, else break out of retry loop
+	// Record how images that passed were built and what they contain
+	if tmp.Success && tmp.Attest != "" {
+		resultString, err := writeAttestations(tmp.Host, tmp.Attest, tmp.Image, run.started, run.finished)
+		stdout = stdout + resultString
 		if err != nil {
-			stdout = stdout + fmt.Sprintf("**Failed** with error: `%v`\nRetries Remaining: %v", err, retries)
-			if retries == 0 {
-				stdout = stdout + fmt.Sprintf("... Moving on")
-				tmp.Success = false
-			}
-			stdout = stdout + fmt.Sprintf("\n\n")
-		} else {
-			tmp.Success = true
-			break
+			tmp.Success = false
 		}
 	}
 
-	return stdout, tmp
+	// Only images that passed all of their tests get their aliases
+	if tmp.Success {
+		resultString, err := tagAliases(tmp.Host, tmp.Image)
+		stdout = stdout + resultString
+		if err != nil {
+			tmp.Success = false
+		}
+	}
+
+	tmp.Output = stdout
+	return finishJob(tmp)
 }
 
-func testBuildTests(tmp Job) (string, Job) {
+func testBuildImage(tmp Job) (string, Job) {
 
-	// Get an array of tests we want to run against our newly built image
-	tests := getTestArray(tmp.Image)
-	stdout := fmt.Sprintf("Array of tests: `%v`\n\n", tests)
+	// Attempt to build the image until we run out of retries
+	stdout, _, err := withRetries(getRetries(tmp.Image, stepBuild, tmp.Retries), isTransient, tmp.retrying(), func() (string, error) {
+		tmp.setState(stateBuilding)
+		return buildImage(tmp.Image["name"].(string), tmp.Image["path"].(string), DockerOpts{
+			BuildArgs: getBuildArgs(tmp.Image),
+			Labels:    imageLabels(tmp.Image),
+			Timeout:   getTimeout(tmp.Image),
+			Host:      tmp.Host,
+			Log:       tmp.Log,
+		})
+	})
+	tmp.Success = err == nil
+	tmp.Cancelled = errors.Is(err, errCancelled)
 
-	for testNum, test := range tests {
-		output, err := testBuildTest(tmp.Image, tmp.Id, tmp.Retries, testNum, test)
+	return stdout, tmp
+}
+
+/*
+testScans runs every scan test of the image built for tmp
+*/
+func testScans(tmp Job) (stdout string, job Job) {
+	for scanNum, scan := range getScanTests(tmp.Image) {
+		output, err := testScan(tmp.Host, tmp.Image, scanNum, scan)
 		stdout = stdout + output
-		if err != nil {
+		if errors.Is(err, errCancelled) {
+			tmp.Cancelled = true
+		}
+		if err != nil && scan.Quarantine {
+			stdout = stdout + fmt.Sprintf("Scan #%v is quarantined, so its failure doesn't fail the image\n\n", scanNum)
+		} else if err != nil {
 			tmp.Success = false
 		}
 	}
-
 	return stdout, tmp
 }
 
-func testBuildTest(image ImageDefinition, id int, retries int, testNum int, test string) (output string, err error) {
+/*
+testBuildTest builds the test of the test job job on top of its image, returning
+a markdown log of the build and how many attempts it took
+*/
+func testBuildTest(job Job) (output string, attempts int, err error) {
+	image, testNum, test := job.Image, job.TestNum, job.Test.Path
 
 	var tempDir string
 
 	// Grab an absolute path to the directory we will store our tests in.
 	// We need to use a temporary directory since we will be modifying the
 	// contents of the directory to build the tests against the base image.
-	localTempPath := tempPath + strconv.Itoa(id)
+	// Every test has its own directory, since the tests of an image run
+	// alongside each other.
+	localTempPath := tempPath + strconv.Itoa(job.Id) + "-" + strconv.Itoa(testNum)
 	tempDir, err = filepath.Abs(localTempPath)
 
 	var testpath string
@@ -174,7 +597,7 @@ func testBuildTest(image ImageDefinition, id int, retries int, testNum int, test
 	output = output + fmt.Sprintf("## Running test #%v\n\n", testNum)
 
 	// Generate a unique name for the test image that we will build
-	testname := image["name"].(string) + "-test" + strconv.Itoa(testNum+1)
+	testname := testImageName(image["name"].(string), testNum)
 
 	// Get the absolute path to the test Dockerfile and context location
 	testpath, err = filepath.Abs(test)
@@ -218,20 +641,55 @@ func testBuildTest(image ImageDefinition, id int, retries int, testNum int, test
 	output = output + fmt.Sprintf("Contents of dockerfile `%v`:\n\n```\n%v\n```\n\n", dockerfile, string(contents))
 	output = output + fmt.Sprintf("Building `%v` from `%v`\n\n", testname, tempDir)
 
+	// A flaky test fails by exiting non-zero, the same as a broken one, so an
+	// image that asks for test retries, or a run keeping a flaky history, has
+	// every failure retried. That is how flaky tests get noticed.
+	transient := isTransient
+	if _, ok := image[stepTest+"_retries"]; ok || job.RetryTests {
+		transient = retryAnyFailure
+	}
+
 	// Build our test image against our base image until we succeed or run out of retries
-	for ; retries >= 0; retries-- {
-		var resultStr string
-		resultStr, err = buildImage(testname, tempDir, DockerOpts{})
-		output = output + fmt.Sprintf("```\n%v\n```\n\n", string(resultStr))
-		if err != nil {
-			output = output + fmt.Sprintf("**Failed** with error: `%v`\nRetries Remaining: %v", err, retries)
-			if retries == 0 {
-				output = output + fmt.Sprintf("... Moving on")
-			}
-			output = output + fmt.Sprintf("\n\n")
-		} else {
-			break
+	var result string
+	tries := 0
+	result, attempts, err = withRetries(getRetries(image, stepTest, job.Retries), transient, job.retrying(), func() (string, error) {
+		job.setState(stateTesting)
+		// The image only exists if this try passes, so it is labelled with
+		// what passing now would mean
+		tries++
+		status := testPassed
+		if tries > 1 {
+			status = testFlaky
 		}
-	}
+		return buildImage(testname, tempDir, DockerOpts{
+			Labels:  testLabels(image, testNum, test, status),
+			Timeout: getTimeout(image),
+			Host:    job.Host,
+			Log:     job.Log,
+		})
+	})
+	output = output + result
 	return
 }
+
+/*
+testDiff reports what changed in the image just built for image on host since
+previous, the image its name pointed at before the build. Images that weren't
+built before, or that came out of the build unchanged, have nothing to report.
+*/
+func testDiff(host *dockerHost, image ImageDefinition, previous string) (output string) {
+	name := image["name"].(string)
+	current, _ := imageId(host, name)
+	if previous == "" || previous == current {
+		return
+	}
+
+	output = fmt.Sprintf("## Changes\n\n")
+	imageDiff, err := diffImages(host, previous, name)
+	if err != nil {
+		return output + fmt.Sprintf("Could not compare with the previous build: `%v`\n\n", err)
+	}
+	// Keep the report readable when a base image update touches every file,
+	// `dante diff` lists everything
+	return output + renderDiff(imageDiff, 50)
+}
@@ -0,0 +1,383 @@
+/*
+tui.go contains the interactive view shown while jobs run when stdout is a
+terminal, which follows every job live instead of printing each job's markdown
+as it finishes
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+sigwinch is the signal a terminal sends when it is resized. It is 28 on every
+unix, and syscall doesn't name it on windows, which never sends it.
+*/
+const sigwinch = syscall.Signal(28)
+
+/*
+tuiLogLines is how many lines of each job's log the view keeps for scrolling
+*/
+const tuiLogLines = 1000
+
+/*
+buildStepPattern matches the lines docker prints as it starts each step of a
+build, with either the classic builder or BuildKit
+*/
+var buildStepPattern = regexp.MustCompile(`^(Step [0-9]+/[0-9]+ : |#[0-9]+ \[[^\]]*[0-9]+/[0-9]+\] )`)
+
+/*
+tuiJob is a single row of the view
+*/
+type tuiJob struct {
+	name     string
+	state    string
+	started  time.Time
+	finished time.Time
+	// step is the build step the job is on, if it is building
+	step string
+	log  []string
+}
+
+/*
+tui draws every job of a run, with the log of the selected job below them
+*/
+type tui struct {
+	mutex    sync.Mutex
+	jobs     []*tuiJob
+	selected int
+	// scroll is how many lines the log is scrolled back from its end, and page
+	// is how many lines of it fit on the screen
+	scroll  int
+	page    int
+	started time.Time
+	// rows and cols are the size of the terminal, read again whenever it is
+	// resized
+	rows int
+	cols int
+	// terminal holds the settings of the terminal from before the view took
+	// it over, as printed by `stty -g`
+	terminal string
+	closing  chan bool
+	closed   chan bool
+	// keysDone is closed once readKeys has stopped reading stdin
+	keysDone chan bool
+}
+
+/*
+useTUI returns true if the view can be shown, which needs a terminal that is
+able to draw it on stdout and keys from stdin
+*/
+func useTUI() bool {
+	if term := os.Getenv("TERM"); term == "" || term == "dumb" {
+		return false
+	}
+	for _, file := range []*os.File{os.Stdout, os.Stdin} {
+		info, err := file.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func newTUI() *tui {
+	return &tui{
+		closing:  make(chan bool),
+		closed:   make(chan bool),
+		keysDone: make(chan bool),
+	}
+}
+
+/*
+add adds a queued job called name to the view, and returns the functions to
+set as the job's Log and State so the view can follow it
+*/
+func (ui *tui) add(name string) (log func(line string), state func(state string)) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	job := &tuiJob{name: name, state: stateQueued}
+	ui.jobs = append(ui.jobs, job)
+
+	log = func(line string) {
+		ui.mutex.Lock()
+		defer ui.mutex.Unlock()
+		line = printable(line)
+		if buildStepPattern.MatchString(line) {
+			job.step = line
+		}
+		job.log = append(job.log, line)
+		if len(job.log) > tuiLogLines {
+			job.log = job.log[len(job.log)-tuiLogLines:]
+		}
+	}
+	state = func(state string) {
+		ui.mutex.Lock()
+		defer ui.mutex.Unlock()
+		if job.started.IsZero() {
+			job.started = time.Now()
+		}
+		switch state {
+		case statusPassed, statusFailed, statusCancelled, statusSkipped:
+			job.finished = time.Now()
+			job.step = ""
+		}
+		job.state = state
+	}
+	return
+}
+
+/*
+printable replaces tabs in line with spaces and drops any other control
+characters, which would upset the view if they reached the terminal
+*/
+func printable(line string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r < ' ' || r == 0x7f:
+			return -1
+		}
+		return r
+	}, line)
+}
+
+/*
+stty runs stty with args against the terminal on stdin
+*/
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+/*
+start takes over the terminal and draws the view until stop is called. The
+terminal is put in raw mode so keys arrive as they are pressed, and reads give
+up after a tenth of a second so readKeys can notice the view has stopped.
+Without stty keys can't be read that way, so the view only follows the jobs.
+*/
+func (ui *tui) start() {
+	ui.started = time.Now()
+	ui.rows, ui.cols = terminalSize()
+	if terminal, err := stty("-g"); err == nil {
+		ui.terminal = terminal
+		stty("raw", "-echo", "min", "0", "time", "1")
+		go ui.readKeys()
+	} else {
+		close(ui.keysDone)
+	}
+	// Switch to the alternate screen and hide the cursor
+	fmt.Printf("\x1b[?1049h\x1b[?25l")
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, sigwinch)
+	go func() {
+		defer signal.Stop(resized)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			ui.draw()
+			select {
+			case <-ticker.C:
+			case <-resized:
+				rows, cols := terminalSize()
+				ui.mutex.Lock()
+				ui.rows, ui.cols = rows, cols
+				ui.mutex.Unlock()
+			case <-ui.closing:
+				close(ui.closed)
+				return
+			}
+		}
+	}()
+}
+
+/*
+stop hands the terminal back the way start found it, once the view has stopped
+reading keys so nothing typed afterwards is swallowed
+*/
+func (ui *tui) stop() {
+	close(ui.closing)
+	<-ui.closed
+	<-ui.keysDone
+	fmt.Printf("\x1b[?25h\x1b[?1049l")
+	if ui.terminal != "" {
+		stty(ui.terminal)
+	}
+}
+
+/*
+readKeys handles keys pressed while the view is shown: up and down (or k and
+j) select a job, page up and page down scroll its log, and q or ctrl-c stop
+the run the same way --fail-fast does
+*/
+func (ui *tui) readKeys() {
+	defer close(ui.keysDone)
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		select {
+		case <-ui.closing:
+			return
+		default:
+		}
+		// A read that timed out without a key comes back empty
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		key := string(buf[:n])
+
+		ui.mutex.Lock()
+		switch key {
+		case "\x1b[A", "k":
+			if ui.selected > 0 {
+				ui.selected--
+				ui.scroll = 0
+			}
+		case "\x1b[B", "j":
+			if ui.selected < len(ui.jobs)-1 {
+				ui.selected++
+				ui.scroll = 0
+			}
+		case "\x1b[5~":
+			ui.scroll += ui.page
+		case "\x1b[6~":
+			ui.scroll -= ui.page
+			if ui.scroll < 0 {
+				ui.scroll = 0
+			}
+		case "q", "\x03":
+			cancelJobs()
+		}
+		ui.mutex.Unlock()
+	}
+}
+
+/*
+terminalSize returns the rows and columns of the terminal, guessing if stty
+can't tell
+*/
+func terminalSize() (rows int, cols int) {
+	size, err := stty("size")
+	if err != nil {
+		return 24, 80
+	}
+	if _, err := fmt.Sscan(size, &rows, &cols); err != nil || rows < 4 || cols < 20 {
+		return 24, 80
+	}
+	return
+}
+
+/*
+elapsed describes how long job has been running, or ran for
+*/
+func (job *tuiJob) elapsed() string {
+	if job.started.IsZero() {
+		return "-"
+	}
+	end := job.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(job.started).Round(time.Second).String()
+}
+
+/*
+draw redraws the whole view: a summary of the run, a row for each job, and the
+end of the selected job's log
+*/
+func (ui *tui) draw() {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	rows, cols := ui.rows, ui.cols
+
+	counts := make(map[string]int)
+	for _, job := range ui.jobs {
+		counts[job.state]++
+	}
+	running := len(ui.jobs) - counts[stateQueued] - counts[statusPassed] - counts[statusFailed] - counts[statusCancelled] - counts[statusSkipped]
+	lines := []string{
+		fmt.Sprintf("dante: %v running, %v queued, %v passed, %v failed, %v",
+			running, counts[stateQueued], counts[statusPassed], counts[statusFailed]+counts[statusCancelled],
+			time.Since(ui.started).Round(time.Second)),
+		"",
+	}
+
+	// Half of the screen goes to the jobs, scrolled to keep the selected one
+	// in view, and the rest to its log
+	height := len(ui.jobs)
+	if most := (rows - 4) / 2; height > most {
+		height = most
+	}
+	first := 0
+	if ui.selected >= height {
+		first = ui.selected - height + 1
+	}
+	for i := first; i < first+height && i < len(ui.jobs); i++ {
+		job := ui.jobs[i]
+		line := truncate(strings.TrimRight(fmt.Sprintf("  %-9v %7v  %v  %v", job.state, job.elapsed(), job.name, job.step), " "), cols)
+		if i == ui.selected {
+			line = "\x1b[7m" + line + strings.Repeat(" ", cols-len([]rune(line))) + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+
+	if len(ui.jobs) > 0 {
+		job := ui.jobs[ui.selected]
+		title := fmt.Sprintf("--- %v ", job.name)
+		lines = append(lines, truncate(title+strings.Repeat("-", cols), cols))
+
+		ui.page = rows - len(lines) - 1
+		if ui.page < 1 {
+			ui.page = 1
+		}
+		if most := len(job.log) - ui.page; ui.scroll > most {
+			ui.scroll = most
+		}
+		if ui.scroll < 0 {
+			ui.scroll = 0
+		}
+		end := len(job.log) - ui.scroll
+		start := end - ui.page
+		if start < 0 {
+			start = 0
+		}
+		for _, line := range job.log[start:end] {
+			lines = append(lines, truncate(line, cols))
+		}
+		for len(lines) < rows-1 {
+			lines = append(lines, "")
+		}
+	}
+	lines = append(lines, truncate("up/down: select job  pgup/pgdn: scroll log  q: stop", cols))
+
+	// Draw over the last frame from the top, clearing what is left of each
+	// line. Raw mode needs explicit carriage returns.
+	fmt.Printf("\x1b[H%v\x1b[K\x1b[J", strings.Join(lines, "\x1b[K\r\n"))
+}
+
+/*
+truncate cuts line down to cols characters so it doesn't wrap
+*/
+func truncate(line string, cols int) string {
+	runes := []rune(line)
+	if len(runes) > cols {
+		return string(runes[:cols])
+	}
+	return line
+}
@@ -0,0 +1,221 @@
+/*
+watch.go contains all of the logic specific to the watch command, which tests
+images again whenever their files change
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+fingerprint describes the files at paths, so that any change to them, including
+files being added or removed, changes the fingerprint. Only names, sizes and
+modification times are read, which keeps polling cheap. The temporary contexts
+dante makes for tests are skipped, or testing an image whose context holds them
+would change it.
+*/
+func fingerprint(paths ...string) string {
+	hash := sha256.New()
+	for _, path := range paths {
+		filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(hash, "%v missing\n", file)
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), tempPath) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			fmt.Fprintf(hash, "%v %v %v %v\n", file, info.Size(), info.ModTime().UnixNano(), info.Mode())
+			return nil
+		})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+/*
+imageFingerprint describes everything that goes into testing image: its
+definition, its context, and the contexts and files of its tests
+*/
+func imageFingerprint(image ImageDefinition) string {
+	definition, _ := yaml.Marshal(image)
+	paths := []string{}
+	if path, ok := image["path"].(string); ok {
+		paths = append(paths, path)
+	}
+	paths = append(paths, getTestArray(image)...)
+	for _, scan := range getScanTests(image) {
+		for _, path := range []string{scan.Database, scan.Allowlist} {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return string(definition) + fingerprint(paths...)
+}
+
+/*
+inventoryFingerprint describes the inventory file filename and every file in
+sources, along with the files each of its includes matches now, so that files
+added to an include are noticed as well as edits to the files already read
+*/
+func inventoryFingerprint(filename string, sources inventorySources) string {
+	files := map[string]bool{filename: true}
+	for _, file := range sources.Files {
+		files[file] = true
+	}
+	paths := []string{}
+	for file := range files {
+		paths = append(paths, file)
+	}
+	sort.Strings(paths)
+
+	stamp := fingerprint(paths...)
+	for _, pattern := range sources.Includes {
+		matches, _ := filepath.Glob(pattern)
+		stamp += fmt.Sprintf("%v: %v\n", pattern, matches)
+	}
+	return stamp
+}
+
+/*
+withDependents returns the images named in changed along with every image built
+FROM them, directly or not, which need testing again when they change
+*/
+func withDependents(inventory Inventory, changed map[string]bool) (affected map[string]bool) {
+	affected = make(map[string]bool)
+	for name := range changed {
+		affected[name] = true
+	}
+	// Without a graph, only the changed images are known to be affected
+	graph, err := buildImageGraph(inventory)
+	if err != nil {
+		return
+	}
+	queue := []string{}
+	for name := range changed {
+		queue = append(queue, name)
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, child := range graph.Children[name] {
+			if !affected[child] {
+				affected[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return
+}
+
+/*
+runWatch tests every image in the inventory file filename, then polls every
+interval for changes to the inventory or to the files of its images. Each time
+something changes, the changed images and the images built FROM them are
+tested again, while the results of everything else are kept from before. It
+runs until it is interrupted.
+*/
+func runWatch(filename string, opts TestOpts, interval time.Duration) {
+	opts.Quiet = true
+
+	var inventory Inventory
+	var sources inventorySources
+	var inventoryStamp string
+	fingerprints := make(map[string]string)
+	results := make(map[string]Job)
+	for ; ; time.Sleep(interval) {
+		// A broken inventory is reported once, then left until it changes
+		if stamp := inventoryFingerprint(filename, sources); stamp != inventoryStamp {
+			loaded, read, err := readInventory(filename)
+			// Even a failed load says which files to watch for a fix
+			sources = read
+			inventoryStamp = inventoryFingerprint(filename, sources)
+			if err != nil {
+				fmt.Printf("%v %v\n\n", time.Now().Format("15:04:05"), err)
+				continue
+			}
+			inventory = loaded
+
+			// Hosts only change with the inventory, so they are only asked
+			// for their capacity when it is loaded
+			opts.Hosts, opts.Schedulers = testSchedulers(inventory, opts)
+			reportSchedulers(opts.Hosts, opts.Schedulers)
+		}
+		if inventory == nil {
+			continue
+		}
+
+		changed := make(map[string]bool)
+		current := make(map[string]string)
+		for _, image := range inventory["images"] {
+			name := image["name"].(string)
+			current[name] = imageFingerprint(image)
+			if fingerprints[name] != current[name] {
+				changed[name] = true
+			}
+		}
+		fingerprints = current
+		if len(changed) == 0 {
+			continue
+		}
+
+		opts.Only = withDependents(inventory, changed)
+		names := []string{}
+		for _, image := range inventory["images"] {
+			name := image["name"].(string)
+			if changed[name] {
+				names = append(names, name)
+			} else if opts.Only[name] {
+				names = append(names, name+" (dependent)")
+			}
+		}
+		fmt.Printf("%v testing %v\n", time.Now().Format("15:04:05"), strings.Join(names, ", "))
+
+		started := time.Now()
+		_, _, ran := runTests(inventory, opts)
+		for _, job := range ran {
+			results[job.Image["name"].(string)] = job
+		}
+		reportWatch(inventory, results, opts.Only, time.Since(started))
+	}
+}
+
+/*
+reportWatch prints a line for the latest result of every image in inventory,
+followed by the full output of the images tested this time that failed
+*/
+func reportWatch(inventory Inventory, results map[string]Job, tested map[string]bool, took time.Duration) {
+	failures := []Job{}
+	for _, image := range inventory["images"] {
+		name := image["name"].(string)
+		job, ok := results[name]
+		status := "pending"
+		if ok {
+			status = job.Status
+		}
+		note := ""
+		if !tested[name] {
+			note = " (unchanged)"
+		} else if !job.Success {
+			failures = append(failures, job)
+		}
+		fmt.Printf("  %-9v %v%v\n", status, name, note)
+	}
+	fmt.Printf("  took %v\n\n", took.Round(time.Second/10))
+
+	for _, job := range failures {
+		fmt.Printf("%v", job.Output)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+writeFile writes contents to the file name in dir, failing the test otherwise
+*/
+func writeFile(t *testing.T, dir string, name string, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestInventoryFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	filename := writeFile(t, dir, "inventory.yml", "include: [\"vars.yml\", \"extra/*.yml\"]\nimages: []\n")
+	vars := writeFile(t, dir, "vars.yml", "vars:\n  version: \"1\"\n")
+	extra := filepath.Join(dir, "extra")
+
+	// The include of extra/ matches nothing yet, which fails the load but
+	// still leaves every file and include to watch
+	_, sources, err := readInventory(filename)
+	if err == nil {
+		t.Fatal("expected an include matching nothing to fail")
+	}
+	stamp := inventoryFingerprint(filename, sources)
+
+	// A file that only sets vars is watched
+	writeFile(t, dir, "vars.yml", "vars:\n  version: \"10\"\n")
+	if again := inventoryFingerprint(filename, sources); again == stamp {
+		t.Errorf("editing %v went unnoticed", vars)
+	}
+	stamp = inventoryFingerprint(filename, sources)
+
+	// A new file matching an include is noticed
+	if err := os.Mkdir(extra, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, extra, "more.yml", "images: [\n")
+	if again := inventoryFingerprint(filename, sources); again == stamp {
+		t.Error("a new file matching an include went unnoticed")
+	}
+
+	// A file that fails to load is still watched, so fixing it is noticed
+	_, sources, err = readInventory(filename)
+	if err == nil {
+		t.Fatal("expected a broken included file to fail")
+	}
+	stamp = inventoryFingerprint(filename, sources)
+	writeFile(t, extra, "more.yml", "images: []\n")
+	if again := inventoryFingerprint(filename, sources); again == stamp {
+		t.Error("fixing a broken included file went unnoticed")
+	}
+	if _, _, err = readInventory(filename); err != nil {
+		t.Errorf("expected the fixed inventory to load, got %v", err)
+	}
+}